@@ -0,0 +1,417 @@
+package fdbstore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/utils/ioutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Content defined chunk size bounds, cut points are picked so that chunks
+	// average cdcAvgSize bytes.
+	cdcMinSize = 2 << 10
+	cdcAvgSize = 8 << 10
+	cdcMaxSize = 64 << 10
+	cdcMask    = cdcAvgSize - 1
+
+	// Objects smaller than this are stored in fixed size parts even when
+	// content defined chunking is enabled.
+	chunkedObjectMinSize = 64 << 10
+
+	// Approximate number of chunk bytes written per transaction.
+	chunkWriteBatch = 1 << 20
+	// Number of chunks fetched per transaction when reading.
+	chunkReadBatch = 64
+	// Number of distinct chunks released per transaction.
+	chunkReleaseBatch = 1000
+
+	// A manifest record is the chunk's sha1 followed by its length.
+	chunkRecordSize = sha1.Size + 4
+)
+
+// gearTable maps bytes to random values for the rolling hash. It is derived
+// from a fixed seed, changing it changes every cut point and so defeats
+// deduplication against chunks already stored.
+var gearTable = func() (t [256]uint64) {
+	x := uint64(0x6a09e667f3bcc909)
+	for i := range t {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// chunker splits a stream into content defined chunks using a gear rolling
+// hash, so an edit only changes the chunks around it.
+type chunker struct {
+	r     io.Reader
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, 2*cdcMaxSize)}
+}
+
+// Returns the next chunk, which is only valid until the next call.
+func (c *chunker) next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := cutPoint(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// Makes sure at least cdcMaxSize bytes are buffered unless the stream ended.
+func (c *chunker) fill() error {
+	if c.end-c.start >= cdcMaxSize || c.eof {
+		return nil
+	}
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	for c.end < cdcMaxSize && !c.eof {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cutPoint(data []byte) int {
+	if len(data) <= cdcMinSize {
+		return len(data)
+	}
+	if len(data) > cdcMaxSize {
+		data = data[:cdcMaxSize]
+	}
+	var h uint64
+	for i := 0; i < len(data); i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if i >= cdcMinSize && h&cdcMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+type storedChunk struct {
+	sum  [sha1.Size]byte
+	size int
+	data []byte
+}
+
+// Stores an object as content defined chunks. Every chunk is kept once under
+// its sha1 with a count of the objects referencing it, and the object parts
+// hold the manifest of chunks making up the object. References are counted
+// before the object is committed and released again if the write fails or the
+// object turns out to be stored already, so only a crashed write can leave
+// counts too high, never too low.
+func storeChunkedObject(s *FDBStore, o plumbing.EncodedObject) (header *ObjectHeader, err error) {
+	h := o.Hash()
+	if header, err := s.hasEncodedObject(h); err == nil {
+		return header, nil
+	}
+	reader, err := o.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer ioutil.CheckClose(reader, &err)
+
+	manifest := &FDBObject{s: s}
+	var taken [][sha1.Size]byte
+	defer func() {
+		if err != nil {
+			if rerr := s.releaseChunks(taken); rerr != nil {
+				s.log.WithError(rerr).Warn("failed to release chunks of failed write")
+			}
+		}
+	}()
+	count, err := batchChunks(reader, s.codec, func(batch []storedChunk) error {
+		if err := s.writeChunks(batch, manifest); err != nil {
+			return err
+		}
+		taken = appendChunkSums(taken, batch)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	header, dup, err := s.commitStaged(h, manifest, ObjectHeader{Type: o.Type(), Size: o.Size(), Chunks: count})
+	if err != nil {
+		return nil, err
+	}
+	if dup {
+		// the stored copy holds its own references
+		if err := s.releaseChunks(taken); err != nil {
+			return nil, err
+		}
+		return header, nil
+	}
+	s.log.WithFields(logrus.Fields{"hash": h, "chunks": count}).Debug("stored chunked object")
+	return header, nil
+}
+
+// Splits r into content defined chunks encoded with codec and hands them to
+// flush about chunkWriteBatch bytes at a time, returning the number of chunks.
+// The chunks of a batch own their data, flush may keep them.
+func batchChunks(r io.Reader, codec string, flush func(batch []storedChunk) error) (int, error) {
+	c := newChunker(r)
+	var batch []storedChunk
+	batchSize, count := 0, 0
+	for {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		// data is only valid until the next chunk is cut
+		data = append([]byte(nil), data...)
+		encoded, err := encodeChunk(codec, data)
+		if err != nil {
+			return count, err
+		}
+		batch = append(batch, storedChunk{sum: sha1.Sum(data), size: len(data), data: encoded})
+		batchSize += len(encoded)
+		count++
+		if batchSize >= chunkWriteBatch {
+			if err := flush(batch); err != nil {
+				return count, err
+			}
+			batch, batchSize = nil, 0
+		}
+	}
+	if len(batch) == 0 {
+		return count, nil
+	}
+	return count, flush(batch)
+}
+
+// Writes the chunks not stored yet, takes a reference on all of them and
+// appends them to the manifest.
+func (s *FDBStore) writeChunks(batch []storedChunk, manifest *FDBObject) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	one := make([]byte, 8)
+	binary.LittleEndian.PutUint64(one, 1)
+	_, err := s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+		existing := make([]fdb.FutureByteSlice, len(batch))
+		for i := range batch {
+			existing[i] = tr.Get(s.genChunkDataKey(batch[i].sum[:]))
+		}
+		written := make(map[[sha1.Size]byte]bool)
+		for i, c := range batch {
+			if isNilKey(existing[i].MustGet()) && !written[c.sum] {
+				tr.Set(s.genChunkDataKey(c.sum[:]), packChunk(s.codec, c.data))
+				written[c.sum] = true
+			}
+			tr.Add(s.genChunkRefsKey(c.sum[:]), one)
+		}
+		return
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to write chunks")
+	}
+	record := make([]byte, chunkRecordSize)
+	for _, c := range batch {
+		copy(record, c.sum[:])
+		binary.BigEndian.PutUint32(record[sha1.Size:], uint32(c.size))
+		if _, err := manifest.write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendChunkSums(sums [][sha1.Size]byte, batch []storedChunk) [][sha1.Size]byte {
+	for _, c := range batch {
+		sums = append(sums, c.sum)
+	}
+	return sums
+}
+
+// Drops a reference on each of the chunks in sums, a chunk listed more than
+// once loses as many. Chunks no longer referenced are removed, a concurrent
+// write taking a new reference reads the chunk this clears and bumps the count
+// this reads, so one of the two conflicts.
+func (s *FDBStore) releaseChunks(sums [][sha1.Size]byte) error {
+	counts := make(map[[sha1.Size]byte]int64)
+	order := make([][sha1.Size]byte, 0, len(sums))
+	for _, sum := range sums {
+		if counts[sum] == 0 {
+			order = append(order, sum)
+		}
+		counts[sum]++
+	}
+	for len(order) > 0 {
+		n := len(order)
+		if n > chunkReleaseBatch {
+			n = chunkReleaseBatch
+		}
+		batch := order[:n]
+		_, err := s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+			refs := make([]fdb.FutureByteSlice, len(batch))
+			for i := range batch {
+				refs[i] = tr.Get(s.genChunkRefsKey(batch[i][:]))
+			}
+			for i, sum := range batch {
+				var left int64
+				if v := refs[i].MustGet(); len(v) == 8 {
+					left = int64(binary.LittleEndian.Uint64(v))
+				}
+				left -= counts[sum]
+				if left > 0 {
+					addKey(tr, s.genChunkRefsKey(sum[:]), -counts[sum])
+					continue
+				}
+				tr.Clear(s.genChunkDataKey(sum[:]))
+				tr.Clear(s.genChunkRefsKey(sum[:]))
+			}
+			return
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to release chunks")
+		}
+		order = order[n:]
+	}
+	return nil
+}
+
+// chunkedReader streams a chunked object by reading its manifest and fetching
+// the listed chunks a batch at a time.
+type chunkedReader struct {
+	s        *FDBStore
+	manifest io.ReadCloser
+	batch    [][]byte
+	cur      []byte
+}
+
+func (s *FDBStore) chunkedObjectReader(h plumbing.Hash, header *ObjectHeader) io.ReadCloser {
+	return &chunkedReader{s: s, manifest: s.partsReader(h, header)}
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if len(r.batch) == 0 {
+			if err := r.fetch(); err != nil {
+				return 0, err
+			}
+		}
+		r.cur, r.batch = r.batch[0], r.batch[1:]
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Reads the next manifest records and fetches their chunks in one transaction.
+func (r *chunkedReader) fetch() error {
+	records := make([]byte, chunkReadBatch*chunkRecordSize)
+	n, err := io.ReadFull(r.manifest, records)
+	if err == io.EOF {
+		return io.EOF
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if n%chunkRecordSize != 0 {
+		return errors.Wrap(io.ErrUnexpectedEOF, "truncated chunk manifest")
+	}
+	records = records[:n]
+
+	ret, err := r.s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
+		futures := make([]fdb.FutureByteSlice, 0, n/chunkRecordSize)
+		for i := 0; i < n; i += chunkRecordSize {
+			futures = append(futures, tr.Get(r.s.genChunkDataKey(records[i:i+sha1.Size])))
+		}
+		values := make([][]byte, len(futures))
+		for i, f := range futures {
+			values[i] = f.MustGet()
+		}
+		return values, nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, v := range ret.([][]byte) {
+		record := records[i*chunkRecordSize : (i+1)*chunkRecordSize]
+		if isNilKey(v) {
+			r.s.log.WithField("chunk", plumbing.Hash(*(*[sha1.Size]byte)(record))).Warn("chunk not found")
+			return io.ErrUnexpectedEOF
+		}
+		codec, encoded, err := unpackChunk(v)
+		if err != nil {
+			return err
+		}
+		data, err := decodeChunk(codec, encoded)
+		if err != nil {
+			return err
+		}
+		if len(data) != int(binary.BigEndian.Uint32(record[sha1.Size:])) {
+			return errors.Wrap(io.ErrUnexpectedEOF, "chunk size doesn't match manifest")
+		}
+		if sum := sha1.Sum(data); !bytes.Equal(sum[:], record[:sha1.Size]) {
+			return errors.Errorf("chunk %x doesn't match its sha1", record[:sha1.Size])
+		}
+		r.batch = append(r.batch, data)
+	}
+	return nil
+}
+
+func (r *chunkedReader) Close() error {
+	r.batch, r.cur = nil, nil
+	return r.manifest.Close()
+}
+
+// Chunks can be shared by objects written with different codecs, so every
+// chunk value starts with the length prefixed name of its codec.
+func packChunk(codec string, data []byte) []byte {
+	v := make([]byte, 0, 1+len(codec)+len(data))
+	v = append(v, byte(len(codec)))
+	v = append(v, codec...)
+	return append(v, data...)
+}
+
+func unpackChunk(v []byte) (string, []byte, error) {
+	if len(v) == 0 || len(v) < 1+int(v[0]) {
+		return "", nil, errors.New("failed to decode chunk")
+	}
+	n := 1 + int(v[0])
+	return string(v[1:n]), v[n:], nil
+}
+
+// key = dir[url]/sub[chunk]/tuple[chunk sha1, "data"]
+func (s *FDBStore) genChunkDataKey(sum []byte) fdb.Key {
+	return s.ss[chunkOpKey].Pack(tuple.Tuple{sum, "data"})
+}
+
+// key = dir[url]/sub[chunk]/tuple[chunk sha1, "refs"]
+func (s *FDBStore) genChunkRefsKey(sum []byte) fdb.Key {
+	return s.ss[chunkOpKey].Pack(tuple.Tuple{sum, "refs"})
+}
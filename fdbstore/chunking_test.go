@@ -0,0 +1,137 @@
+package fdbstore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+func randomBytes(n int, seed int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// Splits data into chunks, reading it in short reads so refills are exercised.
+func chunkAll(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	c := newChunker(iotest.HalfReader(bytes.NewReader(data)))
+	var chunks [][]byte
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatalf("chunker: %v", err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunkerBoundsAndReassembly(t *testing.T) {
+	inputs := map[string][]byte{
+		"random":     randomBytes(4<<20, 1),
+		"zeros":      make([]byte, 1<<20),
+		"short":      randomBytes(cdcMinSize/2, 2),
+		"max size":   randomBytes(cdcMaxSize, 3),
+		"repetitive": bytes.Repeat([]byte("git-foundation "), 1<<16),
+	}
+	for name, data := range inputs {
+		chunks := chunkAll(t, data)
+		for i, c := range chunks {
+			if len(c) > cdcMaxSize {
+				t.Errorf("%s: chunk %d is %d bytes, over cdcMaxSize", name, i, len(c))
+			}
+			if i < len(chunks)-1 && len(c) < cdcMinSize {
+				t.Errorf("%s: chunk %d is %d bytes, under cdcMinSize", name, i, len(c))
+			}
+		}
+		if got := bytes.Join(chunks, nil); !bytes.Equal(got, data) {
+			t.Errorf("%s: reassembled %d bytes don't match the %d byte input", name, len(got), len(data))
+		}
+	}
+}
+
+func TestCutPointBounds(t *testing.T) {
+	data := randomBytes(2*cdcMaxSize, 4)
+	if n := cutPoint(data[:cdcMinSize]); n != cdcMinSize {
+		t.Errorf("cutPoint of cdcMinSize bytes = %d, want all of them", n)
+	}
+	if n := cutPoint(make([]byte, 2*cdcMaxSize)); n != cdcMaxSize {
+		t.Errorf("cutPoint without a content cut = %d, want cdcMaxSize", n)
+	}
+	if n := cutPoint(data); n <= cdcMinSize || n > cdcMaxSize {
+		t.Errorf("cutPoint = %d, want within (cdcMinSize, cdcMaxSize]", n)
+	}
+}
+
+func TestChunkerLocalEdit(t *testing.T) {
+	data := randomBytes(4<<20, 5)
+	edited := append([]byte(nil), data...)
+	edited[len(edited)/2] ^= 0xff
+
+	stored := make(map[[sha1.Size]byte]bool)
+	before := chunkAll(t, data)
+	for _, c := range before {
+		stored[sha1.Sum(c)] = true
+	}
+	after := chunkAll(t, edited)
+	changed := 0
+	for _, c := range after {
+		if !stored[sha1.Sum(c)] {
+			changed++
+		}
+	}
+	// the edited chunk and at most the cut points right after it move
+	if changed == 0 || changed > 3 {
+		t.Errorf("one byte edit changed %d of %d chunks, want 1 to 3", changed, len(after))
+	}
+	if len(before) < 100 {
+		t.Errorf("only %d chunks for 4MiB, chunks are too big to dedup", len(before))
+	}
+}
+
+// Runs the batching storeChunkedObject uses and checks every chunk of every
+// batch against its sum once all input is read, so chunks still pointing into
+// the chunker's buffer show up.
+func TestBatchChunksOwnData(t *testing.T) {
+	data := randomBytes(8<<20, 6)
+	for _, codec := range []string{"", CodecZstd} {
+		var batches [][]storedChunk
+		count, err := batchChunks(iotest.HalfReader(bytes.NewReader(data)), codec, func(batch []storedChunk) error {
+			batches = append(batches, batch)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%q: batchChunks: %v", codec, err)
+		}
+		if len(batches) < 2 {
+			t.Fatalf("%q: got %d batches, want several", codec, len(batches))
+		}
+		var got []byte
+		n := 0
+		for _, batch := range batches {
+			for _, c := range batch {
+				decoded, err := decodeChunk(codec, c.data)
+				if err != nil {
+					t.Fatalf("%q: decodeChunk: %v", codec, err)
+				}
+				if sha1.Sum(decoded) != c.sum || len(decoded) != c.size {
+					t.Fatalf("%q: chunk %d doesn't match its sum", codec, n)
+				}
+				got = append(got, decoded...)
+				n++
+			}
+		}
+		if n != count {
+			t.Errorf("%q: batches hold %d chunks, batchChunks counted %d", codec, n, count)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%q: batched chunks don't reassemble to the input", codec)
+		}
+	}
+}
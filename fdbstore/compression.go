@@ -0,0 +1,153 @@
+package fdbstore
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	CodecZlib = "zlib"
+	CodecZstd = "zstd"
+)
+
+var ErrUnknownCodec = fmt.Errorf("unknown chunk codec")
+
+// ChunkCodec compresses object parts before they're written to FDB. Every part
+// is compressed on its own so that objects can still be streamed part by part.
+type ChunkCodec interface {
+	Compress(p []byte) ([]byte, error)
+	Decompress(p []byte) ([]byte, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]ChunkCodec{
+		CodecZlib: zlibCodec{},
+		CodecZstd: &zstdCodec{},
+	}
+)
+
+// RegisterChunkCodec makes a codec available under name. The name is recorded
+// in the header of every object compressed with it, so a codec has to stay
+// registered for as long as objects using it are stored.
+func RegisterChunkCodec(name string, c ChunkCodec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[name] = c
+}
+
+func getChunkCodec(name string) (ChunkCodec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return nil, errors.Wrap(ErrUnknownCodec, name)
+	}
+	return c, nil
+}
+
+// Compresses a part with the named codec, an empty name stores it as is.
+func encodeChunk(codec string, p []byte) ([]byte, error) {
+	if codec == "" {
+		return p, nil
+	}
+	c, err := getChunkCodec(codec)
+	if err != nil {
+		return nil, err
+	}
+	return c.Compress(p)
+}
+
+// Splits p into chunks of ObjectChunkSize compressed with the named codec.
+func encodeParts(codec string, p []byte) ([][]byte, error) {
+	var parts [][]byte
+	for i := 0; i < len(p); i += ObjectChunkSize {
+		end := i + ObjectChunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		c, err := encodeChunk(codec, p[i:end])
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, c)
+	}
+	return parts, nil
+}
+
+func decodeChunk(codec string, p []byte) ([]byte, error) {
+	if codec == "" {
+		return p, nil
+	}
+	c, err := getChunkCodec(codec)
+	if err != nil {
+		return nil, err
+	}
+	d, err := c.Decompress(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decompress %s part", codec)
+	}
+	return d, nil
+}
+
+type zlibCodec struct{}
+
+func (zlibCodec) Compress(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (zlibCodec) Decompress(p []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// zstdCodec shares a single encoder and decoder, both are safe for concurrent
+// use through EncodeAll and DecodeAll.
+type zstdCodec struct {
+	once sync.Once
+	enc  *zstd.Encoder
+	dec  *zstd.Decoder
+	err  error
+}
+
+func (c *zstdCodec) init() error {
+	c.once.Do(func() {
+		if c.enc, c.err = zstd.NewWriter(nil); c.err != nil {
+			return
+		}
+		c.dec, c.err = zstd.NewReader(nil)
+	})
+	return c.err
+}
+
+func (c *zstdCodec) Compress(p []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.enc.EncodeAll(p, nil), nil
+}
+
+func (c *zstdCodec) Decompress(p []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.dec.DecodeAll(p, nil)
+}
@@ -1,46 +1,142 @@
 package fdbstore
 
 import (
+	"bytes"
 	"encoding/json"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
 	"github.com/go-git/go-git/v5/config"
+	format "github.com/go-git/go-git/v5/plumbing/format/config"
 	"github.com/pkg/errors"
 )
 
+// Config reads the config, which is stored as git config text, exactly what
+// go-git writes to .git/config, so sections and options go-git doesn't model
+// round-trip. Configs written before were JSON encoded config.Configs, which
+// always start with '{' and are still read. The repository config is merged
+// with the system and tenant scopes, see ConfigScope.
 func (s *FDBStore) Config() (*config.Config, error) {
+	layers, err := s.configLayers()
+	if err != nil {
+		return nil, err
+	}
+	raw := mergeConfigLayers(layers)
+	c := config.NewConfig()
+	if len(raw) == 0 {
+		return c, nil
+	}
+	if err := c.Unmarshal(raw); err != nil {
+		s.log.WithError(err).Error("config unmarshal failed")
+		return nil, errors.Wrap(err, "failed to decode config")
+	}
+	return c, nil
+}
+
+// SetConfig stores r as the repository config. As r usually comes from Config
+// only what r changes from the system and tenant scopes is stored.
+func (s *FDBStore) SetConfig(r *config.Config) error {
+	payload, err := encodeConfig(r)
+	if err != nil {
+		return err
+	}
+	layers, err := s.configLayers()
+	if err != nil {
+		return err
+	}
+	repo := len(layers) - 1
+	own, err := repositoryConfig(payload, mergeConfigLayers(layers[:repo]))
+	if err != nil {
+		return errors.Wrap(err, "failed to split off inherited config")
+	}
+	return s.writeValue(s.genConfigKey(), own, nil)
+}
+
+// ConfigRaw exports the config in git config format, as it would be in
+// .git/config.
+func (s *FDBStore) ConfigRaw() ([]byte, error) {
 	ret, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
-		ret = tr.Get(s.genConfigKey()).MustGet()
-		return
+		return s.readValue(tr, s.genConfigKey())
 	})
 	if err != nil {
 		return nil, err
 	}
-	i := new(config.Config)
+	c, _ := ret.([]byte)
+	if isJSONConfig(c) {
+		return s.convertJSONConfig(c)
+	}
+	return c, nil
+}
+
+// SetConfigRaw imports a config in git config format. The text is stored as
+// is, once checked to parse.
+func (s *FDBStore) SetConfigRaw(b []byte) error {
+	if err := config.NewConfig().Unmarshal(b); err != nil {
+		return errors.Wrap(err, "invalid config")
+	}
+	return s.setConfigRaw(b)
+}
+
+func (s *FDBStore) setConfigRaw(b []byte) error {
+	return s.writeValue(s.genConfigKey(), b, nil)
+}
 
-	if ret == nil {
-		return config.NewConfig(), nil
+// MigrateConfig rewrites a config still stored as JSON in git config format,
+// reporting whether there was one to migrate. JSON configs are still read, so
+// migrating is optional.
+func (s *FDBStore) MigrateConfig() (bool, error) {
+	ret, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
+		ret = tr.Get(s.genConfigKey()).MustGet()
+		return
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "failed to migrate config")
+	}
+	c, _ := ret.([]byte)
+	if !isJSONConfig(c) {
+		return false, nil
+	}
+	payload, err := s.convertJSONConfig(c)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to migrate config")
 	}
-	c := ret.([]byte)
-	if len(c) == 0 {
-		return config.NewConfig(), nil
+	// only replace the JSON config read above
+	err = s.writeValue(s.genConfigKey(), payload, func(tr fdb.Transaction) error {
+		if !bytes.Equal(tr.Get(s.genConfigKey()).MustGet(), c) {
+			return ErrValueChanged
+		}
+		return nil
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "failed to migrate config")
 	}
-	if err = json.Unmarshal(c, i); err != nil {
+	return true, nil
+}
+
+func isJSONConfig(c []byte) bool {
+	return len(c) > 0 && c[0] == '{'
+}
+
+// Converts a JSON encoded config to git config format.
+func (s *FDBStore) convertJSONConfig(c []byte) ([]byte, error) {
+	i := config.NewConfig()
+	if err := json.Unmarshal(c, i); err != nil {
 		s.log.WithError(err).Error("config unmarshal failed")
+		return nil, errors.Wrap(err, "failed to decode json config")
 	}
-	return i, err
+	return encodeConfig(i)
 }
 
-func (s *FDBStore) SetConfig(r *config.Config) error {
-	payload, err := json.Marshal(r)
+// Encodes c in git config format. Configs not read through Unmarshal, like a
+// bare config.Config{}, have no Raw for Marshal to write into.
+func encodeConfig(c *config.Config) ([]byte, error) {
+	if c.Raw == nil {
+		c.Raw = format.New()
+	}
+	payload, err := c.Marshal()
 	if err != nil {
-		return errors.Wrap(err, "failed to encode config")
+		return nil, errors.Wrap(err, "failed to encode config")
 	}
-	_, err = s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
-		tr.Set(s.genConfigKey(), payload)
-		return
-	})
-	return err
+	return payload, nil
 }
 
 func (s *FDBStore) genConfigKey() fdb.Key {
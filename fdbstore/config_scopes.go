@@ -0,0 +1,260 @@
+package fdbstore
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	format "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/pkg/errors"
+)
+
+// Name of the directory holding the config documents shared between
+// repositories.
+const configScopesDirName = "config-scopes"
+
+// ConfigScope is one of the layers the config of a repository is merged from,
+// like git's system, global and local config files.
+type ConfigScope int
+
+const (
+	// ScopeSystem config applies to every repository.
+	ScopeSystem ConfigScope = iota
+	// ScopeTenant config applies to the repositories of a tenant, the ns the
+	// store was opened with.
+	ScopeTenant
+	// ScopeRepository config applies to a single repository.
+	ScopeRepository
+)
+
+// Scopes in the order they're merged, later ones take precedence.
+var configScopes = []ConfigScope{ScopeSystem, ScopeTenant, ScopeRepository}
+
+func (c ConfigScope) String() string {
+	switch c {
+	case ScopeSystem:
+		return "system"
+	case ScopeTenant:
+		return "tenant"
+	case ScopeRepository:
+		return "repository"
+	}
+	return fmt.Sprintf("ConfigScope(%d)", int(c))
+}
+
+// ConfigValue is a config value and the scope it's set in.
+type ConfigValue struct {
+	Scope ConfigScope
+	Value string
+}
+
+// ConfigScopeRaw exports the config document of scope in git config format.
+func (s *FDBStore) ConfigScopeRaw(scope ConfigScope) ([]byte, error) {
+	if scope == ScopeRepository {
+		return s.ConfigRaw()
+	}
+	key, err := s.genConfigScopeKey(scope)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
+		return s.readValue(tr, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c, _ := ret.([]byte)
+	return c, nil
+}
+
+// SetConfigScopeRaw imports the config document of scope in git config
+// format. System and tenant documents are shared by every repository in their
+// scope, changing them changes the config of all of them.
+func (s *FDBStore) SetConfigScopeRaw(scope ConfigScope, b []byte) error {
+	if scope == ScopeRepository {
+		return s.SetConfigRaw(b)
+	}
+	key, err := s.genConfigScopeKey(scope)
+	if err != nil {
+		return err
+	}
+	if _, err := decodeRawConfig(b); err != nil {
+		return errors.Wrap(err, "invalid config")
+	}
+	return s.writeValue(key, b, nil)
+}
+
+// ConfigValues returns every value of key in the given section and
+// subsection along with the scope it's set in, in precedence order, so the
+// last value is the one in effect.
+func (s *FDBStore) ConfigValues(section, subsection, key string) ([]ConfigValue, error) {
+	layers, err := s.configLayers()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]ConfigValue, 0)
+	for i, l := range layers {
+		raw, err := decodeRawConfig(l)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode %s config", configScopes[i])
+		}
+		for _, v := range rawOptions(raw, section, subsection).GetAll(key) {
+			values = append(values, ConfigValue{Scope: configScopes[i], Value: v})
+		}
+	}
+	return values, nil
+}
+
+// Reads the documents of all scopes in one transaction, in merge order.
+func (s *FDBStore) configLayers() ([][]byte, error) {
+	ret, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
+		return s.readConfigLayers(tr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret.([][]byte), nil
+}
+
+func (s *FDBStore) readConfigLayers(tr fdb.ReadTransaction) ([][]byte, error) {
+	keys := make([]fdb.Key, 0, len(configScopes))
+	for _, scope := range configScopes {
+		if scope == ScopeRepository {
+			keys = append(keys, s.genConfigKey())
+			continue
+		}
+		key, err := s.genConfigScopeKey(scope)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	futures := make([]fdb.FutureByteSlice, len(keys))
+	for i, k := range keys {
+		futures[i] = tr.Get(k)
+	}
+	layers := make([][]byte, len(keys))
+	for i, f := range futures {
+		var err error
+		if layers[i], err = s.resolveValue(tr, keys[i], f.MustGet()); err != nil {
+			return nil, err
+		}
+	}
+	repo := len(layers) - 1
+	if isJSONConfig(layers[repo]) {
+		var err error
+		if layers[repo], err = s.convertJSONConfig(layers[repo]); err != nil {
+			return nil, err
+		}
+	}
+	return layers, nil
+}
+
+// Merges the config documents of all scopes into one. Like git reading its
+// config files one after the other, values of later scopes follow those of
+// earlier ones, so single valued options take the last one.
+func mergeConfigLayers(layers [][]byte) []byte {
+	var b bytes.Buffer
+	for _, l := range layers {
+		b.Write(l)
+		if len(l) > 0 && l[len(l)-1] != '\n' {
+			b.WriteByte('\n')
+		}
+	}
+	return b.Bytes()
+}
+
+// Returns the part of the repository config c that isn't inherited from the
+// system and tenant scopes. go-git hands back the merged config to be stored,
+// so inherited values leading the values of an option are dropped.
+func repositoryConfig(c []byte, inherited []byte) ([]byte, error) {
+	merged, err := decodeRawConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := decodeRawConfig(inherited)
+	if err != nil {
+		return nil, err
+	}
+
+	out := format.New()
+	keep := func(section, subsection string, opts format.Options) {
+		done := make(map[string]bool)
+		for _, o := range opts {
+			if done[o.Key] {
+				continue
+			}
+			done[o.Key] = true
+			values := opts.GetAll(o.Key)
+			if pv := rawOptions(parent, section, subsection).GetAll(o.Key); hasPrefixValues(values, pv) {
+				values = values[len(pv):]
+			}
+			for _, v := range values {
+				out.AddOption(section, subsection, o.Key, v)
+			}
+		}
+	}
+	for _, sec := range merged.Sections {
+		keep(sec.Name, "", sec.Options)
+		for _, sub := range sec.Subsections {
+			keep(sec.Name, sub.Name, sub.Options)
+		}
+	}
+	var b bytes.Buffer
+	if err := format.NewEncoder(&b).Encode(out); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func decodeRawConfig(b []byte) (*format.Config, error) {
+	c := format.New()
+	if err := format.NewDecoder(bytes.NewReader(b)).Decode(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Returns the options of a section, or of one of its subsections if
+// subsection is set, without adding them to c like c.Section does.
+func rawOptions(c *format.Config, section, subsection string) format.Options {
+	for _, sec := range c.Sections {
+		if !sec.IsName(section) {
+			continue
+		}
+		if subsection == "" {
+			return sec.Options
+		}
+		for _, sub := range sec.Subsections {
+			if sub.IsName(subsection) {
+				return sub.Options
+			}
+		}
+	}
+	return nil
+}
+
+func hasPrefixValues(values, prefix []string) bool {
+	if len(prefix) > len(values) {
+		return false
+	}
+	for i := range prefix {
+		if values[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// key = dir[config-scopes]/tuple[system]
+// key = dir[config-scopes]/tuple[tenant, ns]
+func (s *FDBStore) genConfigScopeKey(scope ConfigScope) (fdb.Key, error) {
+	switch scope {
+	case ScopeSystem:
+		return s.scopes.Pack(tuple.Tuple{"system"}), nil
+	case ScopeTenant:
+		return s.scopes.Pack(tuple.Tuple{"tenant", s.tenant}), nil
+	}
+	return nil, fmt.Errorf("no shared config for scope %s", scope)
+}
@@ -0,0 +1,98 @@
+package fdbstore
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-git/v5/config"
+)
+
+// Does what Config followed by SetConfig does to the layers, returning the
+// repository layer that would be stored.
+func configRoundTrip(t *testing.T, system, tenant, repo string, edit func(c *config.Config)) *config.Config {
+	t.Helper()
+	layers := [][]byte{[]byte(system), []byte(tenant), []byte(repo)}
+	c := config.NewConfig()
+	if err := c.Unmarshal(mergeConfigLayers(layers)); err != nil {
+		t.Fatalf("failed to decode merged config: %v", err)
+	}
+	if edit != nil {
+		edit(c)
+	}
+	payload, err := c.Marshal()
+	if err != nil {
+		t.Fatalf("failed to encode config: %v", err)
+	}
+	own, err := repositoryConfig(payload, mergeConfigLayers(layers[:2]))
+	if err != nil {
+		t.Fatalf("repositoryConfig: %v", err)
+	}
+	stored := config.NewConfig()
+	if err := stored.Unmarshal(own); err != nil {
+		t.Fatalf("failed to decode repository layer %q: %v", own, err)
+	}
+	return stored
+}
+
+func TestMergeConfigLayers(t *testing.T) {
+	got := string(mergeConfigLayers([][]byte{
+		[]byte("[core]\n\tbare = true"),
+		nil,
+		[]byte("[core]\n\tbare = false\n"),
+	}))
+	want := "[core]\n\tbare = true\n[core]\n\tbare = false\n"
+	if got != want {
+		t.Errorf("mergeConfigLayers = %q, want %q", got, want)
+	}
+}
+
+func TestRepositoryConfigDropsInherited(t *testing.T) {
+	stored := configRoundTrip(t,
+		"[user]\n\tname = system\n",
+		"[pack]\n\twindow = 20\n",
+		"[core]\n\tbare = true\n",
+		nil)
+	if v := stored.Raw.Section("user").Option("name"); v != "" {
+		t.Errorf("system user.name stored in repository layer: %q", v)
+	}
+	if v := stored.Raw.Section("pack").Option("window"); v != "" {
+		t.Errorf("tenant pack.window stored in repository layer: %q", v)
+	}
+	if !stored.Core.IsBare {
+		t.Errorf("repository core.bare lost")
+	}
+}
+
+func TestRepositoryConfigKeepsOverride(t *testing.T) {
+	stored := configRoundTrip(t,
+		"[core]\n\tbare = true\n",
+		"",
+		"[core]\n\tbare = false\n",
+		nil)
+	if v := stored.Raw.Section("core").Option("bare"); v != "false" {
+		t.Errorf("repository core.bare = %q, want false", v)
+	}
+
+	// an override made through the merged config sticks too
+	stored = configRoundTrip(t,
+		"[core]\n\tbare = false\n",
+		"",
+		"",
+		func(c *config.Config) { c.Core.IsBare = true })
+	if v := stored.Raw.Section("core").Option("bare"); v != "true" {
+		t.Errorf("repository core.bare = %q, want true", v)
+	}
+}
+
+func TestRepositoryConfigMultiValued(t *testing.T) {
+	stored := configRoundTrip(t,
+		"[hooks]\n\tpath = system-a\n\tpath = system-b\n",
+		"[hooks]\n\tpath = tenant\n",
+		"[hooks]\n\tpath = repo-a\n\tpath = repo-b\n",
+		nil)
+	got := stored.Raw.Section("hooks").Options.GetAll("path")
+	want := []string{"repo-a", "repo-b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("repository hooks.path = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,23 @@
+package fdbstore
+
+import (
+	"testing"
+
+	"github.com/go-git/go-git/v5/config"
+)
+
+func TestEncodeConfigWithoutRaw(t *testing.T) {
+	c := &config.Config{}
+	c.Core.IsBare = true
+	payload, err := encodeConfig(c)
+	if err != nil {
+		t.Fatalf("encodeConfig: %v", err)
+	}
+	decoded := config.NewConfig()
+	if err := decoded.Unmarshal(payload); err != nil {
+		t.Fatalf("failed to decode %q: %v", payload, err)
+	}
+	if !decoded.Core.IsBare {
+		t.Errorf("core.bare lost encoding %q", payload)
+	}
+}
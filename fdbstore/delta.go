@@ -0,0 +1,304 @@
+package fdbstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"sort"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/utils/ioutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Objects bigger than this are always stored in full, both the base and the
+// target have to be held in memory to compute or apply a delta.
+const maxDeltaObjectSize = maxInlineObjectSize
+
+// Number of previously seen objects DeltifyObjects tries as delta bases.
+const deltifyWindow = 10
+
+// DeltaHeader describes an object whose parts hold a REF style delta, the
+// delta refers to its base by hash rather than by pack offset.
+type DeltaHeader struct {
+	// Base is the hash of the object the delta applies to.
+	Base string
+	// Size is the uncompressed size of the delta stored in the object parts.
+	Size int64
+	// Depth is the length of the delta chain down to a full object.
+	Depth int
+}
+
+func deltaDepth(h *ObjectHeader) int {
+	if h.Delta == nil {
+		return 0
+	}
+	return h.Delta.Depth
+}
+
+// A delta is only worth storing when it's at most half the object size.
+func worthDelta(delta, target int) bool {
+	return delta < target/2
+}
+
+// Rebuilds a delta object in memory by applying it to its base, which may be
+// a delta itself.
+func (s *FDBStore) deltaObjectReader(h plumbing.Hash, header *ObjectHeader) (io.ReadCloser, error) {
+	delta, err := io.ReadAll(s.partsReader(h, header))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read delta")
+	}
+	base, err := s.getEncodedObject(plumbing.AnyObject, plumbing.NewHash(header.Delta.Base))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get delta base %s", header.Delta.Base)
+	}
+	src, err := readObject(base)
+	if err != nil {
+		return nil, err
+	}
+	content, err := packfile.PatchDelta(src, delta)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to apply delta to %s", header.Delta.Base)
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+// SetEncodedObjectDelta stores o as a delta against the object base, falling
+// back to storing it in full when deltas are disabled, the delta chain would
+// get too deep or the delta doesn't save enough space.
+func (s *FDBStore) SetEncodedObjectDelta(o plumbing.EncodedObject, base plumbing.Hash) (plumbing.Hash, error) {
+	if s.maxDeltaDepth == 0 || o.Size() > maxDeltaObjectSize {
+		return s.SetEncodedObject(o)
+	}
+	h := o.Hash()
+	if _, err := s.hasEncodedObject(h); err == nil {
+		return h, nil
+	}
+	b, err := s.getEncodedObject(plumbing.AnyObject, base)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	bh := b.(*FDBObject).header
+	if deltaDepth(bh) >= s.maxDeltaDepth || bh.Size > maxDeltaObjectSize {
+		return s.SetEncodedObject(o)
+	}
+	src, err := readObject(b)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	tgt, err := readObject(o)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	delta := packfile.DiffDelta(src, tgt)
+	if !worthDelta(len(delta), len(tgt)) {
+		return s.SetEncodedObject(o)
+	}
+	if _, err := s.storeDelta(h, o.Type(), int64(len(tgt)), nil, base, deltaDepth(bh)+1, delta); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return h, nil
+}
+
+// Writes the object h as a delta against base. When old is set an existing
+// full object is rewritten, which only happens if it is unchanged and isn't a
+// delta base itself, the returned bool reports whether the delta was stored.
+func (s *FDBStore) storeDelta(h plumbing.Hash, t plumbing.ObjectType, size int64, old *ObjectHeader, base plumbing.Hash, depth int, delta []byte) (bool, error) {
+	parts, err := encodeParts(s.codec, delta)
+	if err != nil {
+		return false, err
+	}
+	header := &ObjectHeader{
+		Type:  t,
+		Size:  size,
+		Codec: s.codec,
+		Parts: len(parts),
+		Delta: &DeltaHeader{Base: base.String(), Size: int64(len(delta)), Depth: depth},
+	}
+	if old != nil {
+		// rewritten objects get their parts in a fresh stage, so readers still
+		// holding the old header fail on missing parts instead of reading the
+		// delta as content
+		if header.Stage, err = newStageID(); err != nil {
+			return false, err
+		}
+	}
+	payload, err := json.Marshal(header)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to encode object header for storage")
+	}
+	ret, err := s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+		cur := tr.Get(s.genObjectMetaKey(h, "header")).MustGet()
+		if old == nil && !isNilKey(cur) {
+			return false, nil
+		}
+		if old != nil {
+			if ok, err := s.deltaRewritable(tr, h, old, cur); err != nil || !ok {
+				return false, err
+			}
+			tr.ClearRange(s.ss[objectOpKey].Sub(h.String(), "part"))
+			if old.Stage != "" {
+				tr.ClearRange(s.ss[stageOpKey].Sub(old.Stage))
+			}
+		}
+
+		bret := tr.Get(s.genObjectMetaKey(base, "header")).MustGet()
+		if isNilKey(bret) {
+			return nil, plumbing.ErrObjectNotFound
+		}
+		bh := new(ObjectHeader)
+		if err := json.Unmarshal(bret, bh); err != nil {
+			return nil, errors.Wrap(err, "failed to decode delta base header")
+		}
+		if deltaDepth(bh)+1 != depth {
+			// the base was rewritten in the meantime
+			return false, nil
+		}
+
+		for i, p := range parts {
+			tr.Set(s.objectPartKey(h, header, i), p)
+		}
+		tr.Set(s.genObjectMetaKey(h, "header"), payload)
+		tr.Set(s.genObjectMetaKeyByType(t, h, "header"), payload)
+		tr.Set(s.genObjectDeltaKey(base, h), []byte{})
+		return true, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if ret.(bool) {
+		s.log.WithFields(logrus.Fields{"hash": h, "base": base, "depth": depth, "delta_size": len(delta)}).Debug("stored object as delta")
+	}
+	return ret.(bool), nil
+}
+
+// An object can only be rewritten as a delta if its header is the one the
+// delta was computed for and no other object uses it as a delta base, as the
+// chains depending on it would otherwise grow past their depth.
+func (s *FDBStore) deltaRewritable(tr fdb.Transaction, h plumbing.Hash, old *ObjectHeader, cur []byte) (bool, error) {
+	if isNilKey(cur) {
+		return false, nil
+	}
+	ch := new(ObjectHeader)
+	if err := json.Unmarshal(cur, ch); err != nil {
+		return false, errors.Wrap(err, "failed to decode object header")
+	}
+	if !reflect.DeepEqual(ch, old) {
+		return false, nil
+	}
+	children, err := tr.GetRange(s.ss[objectOpKey].Sub(h.String(), "delta"), fdb.RangeOptions{Limit: 1}).GetSliceWithError()
+	if err != nil {
+		return false, err
+	}
+	return len(children) == 0, nil
+}
+
+type deltaCandidate struct {
+	h       plumbing.Hash
+	header  *ObjectHeader
+	depth   int
+	content []byte
+}
+
+// DeltifyObjects is a background pass that rewrites full objects of type t as
+// deltas. Objects are sorted by size and each one is diffed against a window
+// of the previously seen objects, similar to how git picks delta bases when
+// packing. It returns the number of objects rewritten.
+func (s *FDBStore) DeltifyObjects(t plumbing.ObjectType) (int, error) {
+	if s.maxDeltaDepth == 0 {
+		return 0, nil
+	}
+	types := []plumbing.ObjectType{t}
+	if t == plumbing.AnyObject {
+		types = storedObjectTypes
+	}
+	count := 0
+	for _, t := range types {
+		n, err := s.deltifyType(t)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func (s *FDBStore) deltifyType(t plumbing.ObjectType) (int, error) {
+	var candidates []*deltaCandidate
+	iter := newObjectIter(s, []plumbing.ObjectType{t})
+	err := iter.ForEach(func(o plumbing.EncodedObject) error {
+		fo := o.(*FDBObject)
+		if fo.header.Delta == nil && fo.header.Chunks == 0 && fo.header.Size <= maxDeltaObjectSize {
+			candidates = append(candidates, &deltaCandidate{h: fo.h, header: fo.header})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].header.Size < candidates[j].header.Size
+	})
+
+	count := 0
+	var window []*deltaCandidate
+	for i, c := range candidates {
+		// only the window holds on to contents
+		candidates[i] = nil
+		content, err := readObject(newFDBObject(s, c.h, c.header))
+		if err != nil {
+			return count, err
+		}
+		c.content = content
+
+		var best *deltaCandidate
+		var bestDelta []byte
+		for _, w := range window {
+			if w.depth >= s.maxDeltaDepth {
+				continue
+			}
+			d := packfile.DiffDelta(w.content, content)
+			if bestDelta == nil || len(d) < len(bestDelta) {
+				best, bestDelta = w, d
+			}
+		}
+		if best != nil && worthDelta(len(bestDelta), len(content)) {
+			ok, err := s.storeDelta(c.h, t, c.header.Size, c.header, best.h, best.depth+1, bestDelta)
+			if err != nil {
+				return count, err
+			}
+			if ok {
+				c.depth = best.depth + 1
+				count++
+			}
+		}
+
+		window = append(window, c)
+		if len(window) > deltifyWindow {
+			window[0].content = nil
+			window[0] = nil
+			window = window[1:]
+		}
+	}
+	s.log.WithField("type", t).WithField("count", count).Info("deltified objects")
+	return count, nil
+}
+
+func readObject(o plumbing.EncodedObject) (content []byte, err error) {
+	r, err := o.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer ioutil.CheckClose(r, &err)
+	return io.ReadAll(r)
+}
+
+// key = dir[url]/sub[obj]/tuple[base hash, "delta", hash]
+func (s *FDBStore) genObjectDeltaKey(base, h plumbing.Hash) fdb.Key {
+	return s.ss[objectOpKey].Pack(tuple.Tuple{base.String(), "delta", h.String()})
+}
@@ -0,0 +1,305 @@
+package fdbstore
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+const (
+	// Number of chunks buffered by an FDBObject writer before they're flushed
+	// to the staging area in a single transaction.
+	stageFlushParts = 100
+	// Number of parts an objectReader fetches per range read.
+	objectReadBatch = 100
+)
+
+var errObjectStored = fmt.Errorf("object has already been stored")
+
+// FDBObject is a plumbing.EncodedObject backed by FoundationDB.
+//
+// Objects fetched from the store only hold their header, the content is
+// streamed part by part when the Reader is consumed. Objects created with
+// NewEncodedObject stream written content into a staging area in FDB so that
+// large objects never need to be held in memory. Once stored the staged parts
+// become the object's parts, nothing is copied.
+type FDBObject struct {
+	s  *FDBStore
+	h  plumbing.Hash
+	t  plumbing.ObjectType
+	sz int64
+
+	// header is set once the object is persisted in the store.
+	header *ObjectHeader
+
+	// stage is the id of the staging area chunks are flushed to, it stays
+	// empty as long as the written content fits in buf.
+	stage   string
+	codec   string
+	parts   int
+	written int64
+	buf     []byte
+	hasher  *plumbing.Hasher
+}
+
+func newFDBObject(s *FDBStore, h plumbing.Hash, header *ObjectHeader) *FDBObject {
+	return &FDBObject{s: s, h: h, t: header.Type, sz: header.Size, header: header}
+}
+
+func (o *FDBObject) Hash() plumbing.Hash {
+	if o.h != plumbing.ZeroHash || o.header != nil {
+		return o.h
+	}
+	if o.hasher != nil && o.written == o.sz {
+		o.h = o.hasher.Sum()
+		return o.h
+	}
+
+	// the size wasn't known up front, so rehash the content now that it is
+	r, err := o.Reader()
+	if err != nil {
+		o.s.log.WithError(err).Error("failed to open object for hashing")
+		return plumbing.ZeroHash
+	}
+	defer r.Close()
+	hasher := plumbing.NewHasher(o.t, o.written)
+	if _, err := io.Copy(hasher, r); err != nil {
+		o.s.log.WithError(err).Error("failed to read object for hashing")
+		return plumbing.ZeroHash
+	}
+	o.h = hasher.Sum()
+	return o.h
+}
+
+func (o *FDBObject) Type() plumbing.ObjectType { return o.t }
+
+func (o *FDBObject) SetType(t plumbing.ObjectType) { o.t = t }
+
+func (o *FDBObject) Size() int64 { return o.sz }
+
+func (o *FDBObject) SetSize(s int64) { o.sz = s }
+
+// Reader returns an io.ReadCloser streaming the object's content from FDB.
+func (o *FDBObject) Reader() (io.ReadCloser, error) {
+	if o.header != nil && o.header.Delta != nil {
+		return o.s.deltaObjectReader(o.h, o.header)
+	}
+	if o.header != nil && o.header.Chunks > 0 {
+		return o.s.chunkedObjectReader(o.h, o.header), nil
+	}
+	if o.header != nil {
+		return o.s.partsReader(o.h, o.header), nil
+	}
+	return &objectReader{
+		s:     o.s,
+		key:   func(part int) fdb.Key { return o.s.genStagePartKey(o.stage, part) },
+		codec: o.codec,
+		parts: o.parts,
+		size:  o.written - int64(len(o.buf)),
+		tail:  o.buf,
+	}, nil
+}
+
+// Writer returns an io.WriteCloser that streams content into the staging area.
+func (o *FDBObject) Writer() (io.WriteCloser, error) {
+	if o.header != nil {
+		return nil, errObjectStored
+	}
+	if o.sz > 0 && o.written == 0 {
+		hasher := plumbing.NewHasher(o.t, o.sz)
+		o.hasher = &hasher
+	}
+	return &objectWriter{o}, nil
+}
+
+func (o *FDBObject) write(p []byte) (int, error) {
+	if o.header != nil {
+		return 0, errObjectStored
+	}
+	if o.hasher != nil {
+		o.hasher.Write(p)
+	}
+	o.buf = append(o.buf, p...)
+	o.written += int64(len(p))
+	o.h = plumbing.ZeroHash
+	if o.written > o.sz {
+		// more content than announced, the streaming hash is of no use
+		o.sz = o.written
+		o.hasher = nil
+	}
+	if len(o.buf) >= stageFlushParts*ObjectChunkSize {
+		if err := o.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// flush writes all complete chunks in buf to the staging area.
+func (o *FDBObject) flush() error {
+	if o.stage == "" {
+		id, err := newStageID()
+		if err != nil {
+			return err
+		}
+		o.stage = id
+	}
+	n := len(o.buf) / ObjectChunkSize
+	parts, err := encodeParts(o.codec, o.buf[:n*ObjectChunkSize])
+	if err != nil {
+		return err
+	}
+	_, err = o.s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+		if o.parts == 0 {
+			o.s.markStagePending(tr, o.stage)
+		} else if err := o.s.checkStagePending(tr, o.stage); err != nil {
+			return nil, err
+		}
+		for i, p := range parts {
+			tr.Set(o.s.genStagePartKey(o.stage, o.parts+i), p)
+		}
+		return
+	})
+	if err != nil {
+		return err
+	}
+	o.s.log.WithField("stage", o.stage).WithField("parts", n).Debug("flushed staged parts")
+	o.parts += n
+	o.buf = append(o.buf[:0], o.buf[n*ObjectChunkSize:]...)
+	return nil
+}
+
+type objectWriter struct {
+	o *FDBObject
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	return w.o.write(p)
+}
+
+// Close is a noop, content still buffered is written out when the object is
+// stored with SetEncodedObject.
+func (w *objectWriter) Close() error {
+	return nil
+}
+
+// Returns a reader over the stored parts of an object, which hold the delta or
+// chunk manifest rather than the object content for delta and chunked objects.
+func (s *FDBStore) partsReader(h plumbing.Hash, header *ObjectHeader) *objectReader {
+	return &objectReader{
+		s:     s,
+		key:   func(part int) fdb.Key { return s.objectPartKey(h, header, part) },
+		codec: header.Codec,
+		parts: header.partCount(),
+		size:  header.partsSize(),
+	}
+}
+
+// objectReader lazily reads an object's parts from FDB followed by an optional
+// tail of content not yet in FDB. Parts are fetched in batches with a single
+// range read per batch, while one batch is consumed the next one is already
+// being fetched.
+type objectReader struct {
+	s     *FDBStore
+	key   func(part int) fdb.Key
+	codec string
+	parts int
+	size  int64
+	tail  []byte
+
+	fetched int
+	read    int64
+	ahead   chan partBatch
+	batch   [][]byte
+	cur     []byte
+}
+
+type partBatch struct {
+	parts [][]byte
+	err   error
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if len(r.batch) > 0 {
+			r.cur, r.batch = r.batch[0], r.batch[1:]
+			continue
+		}
+		if r.ahead == nil && r.fetched < r.parts {
+			r.prefetch()
+		}
+		if r.ahead != nil {
+			b := <-r.ahead
+			r.prefetch()
+			if b.err != nil {
+				return 0, b.err
+			}
+			r.batch = b.parts
+			continue
+		}
+		if r.read != r.size {
+			r.s.log.WithField("read", r.read).WithField("size", r.size).Warn("object parts don't add up to object size")
+			return 0, io.ErrUnexpectedEOF
+		}
+		if len(r.tail) == 0 {
+			return 0, io.EOF
+		}
+		r.cur, r.tail = r.tail, nil
+		r.size += int64(len(r.cur))
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	r.read += int64(n)
+	return n, nil
+}
+
+// Starts fetching the next batch of parts in the background, if any are left.
+func (r *objectReader) prefetch() {
+	if r.fetched >= r.parts {
+		r.ahead = nil
+		return
+	}
+	start := r.fetched
+	n := r.parts - start
+	if n > objectReadBatch {
+		n = objectReadBatch
+	}
+	r.fetched += n
+	ch := make(chan partBatch, 1)
+	go func() {
+		parts, err := r.fetch(start, n)
+		ch <- partBatch{parts, err}
+	}()
+	r.ahead = ch
+}
+
+// Reads parts [start, start+n) in one range read and checks none are missing.
+func (r *objectReader) fetch(start, n int) ([][]byte, error) {
+	kr := fdb.KeyRange{Begin: r.key(start), End: r.key(start + n)}
+	ret, err := r.s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
+		ret, e = tr.GetRange(kr, fdb.RangeOptions{Mode: fdb.StreamingModeWantAll}).GetSliceWithError()
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	kvs := ret.([]fdb.KeyValue)
+	if len(kvs) != n {
+		r.s.log.WithField("start", start).WithField("expected", n).WithField("found", len(kvs)).Warn("parts not found")
+		return nil, io.ErrUnexpectedEOF
+	}
+	parts := make([][]byte, n)
+	for i, kv := range kvs {
+		if parts[i], err = decodeChunk(r.codec, kv.Value); err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+func (r *objectReader) Close() error {
+	r.cur, r.batch, r.tail = nil, nil, nil
+	return nil
+}
@@ -1,47 +1,143 @@
 package fdbstore
 
 import (
+	"fmt"
+
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
 	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
 	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
 	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
-	"github.com/go-git/go-git/v5/storage/memory"
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	refOpKey     = "ref"
-	configOpKey  = "config"
-	indexOpKey   = "index"
-	shallowOpKey = "shallow"
-	objectOpKey  = "obj"
+	refOpKey        = "ref"
+	configOpKey     = "config"
+	indexOpKey      = "index"
+	indexDataOpKey  = "idx"
+	shallowOpKey    = "shallow"
+	objectOpKey     = "obj"
+	stageOpKey      = "stage"
+	chunkOpKey      = "chunk"
+	reflogOpKey     = "reflog"
+	refEventOpKey   = "refevent"
+	protectionOpKey = "protection"
 )
 
 type FDBStore struct {
-	memory.ModuleStorage
 	log logrus.FieldLogger
 	db  fdb.Database
 	d   directory.DirectorySubspace
 	ss  map[string]subspace.Subspace
+
+	// codec is the ChunkCodec new object parts are compressed with
+	codec string
+	// maxDeltaDepth limits delta chains, 0 disables delta storage
+	maxDeltaDepth int
+	// chunking stores larger objects as deduplicated content defined chunks
+	chunking bool
+	// refPrefix is the ref name prefix of the selected namespace, see Namespace
+	refPrefix string
+	// hooks run on reference updates, see UpdateReferences
+	preUpdateHooks  []PreUpdateHook
+	postUpdateHooks []PostUpdateHook
+	// scopes holds the config shared by repositories, see ConfigScope
+	scopes directory.DirectorySubspace
+	tenant string
+	// committer is recorded in reflog entries of changes that don't name one
+	committer ReflogIdentity
+}
+
+// StorageOption configures optional behaviour of an FDBStore.
+type StorageOption func(*FDBStore) error
+
+// WithCompression compresses the parts of newly stored objects with the named
+// ChunkCodec. Objects keep the codec they were written with, so stores can be
+// switched between codecs at any time.
+func WithCompression(codec string) StorageOption {
+	return func(s *FDBStore) error {
+		if _, err := getChunkCodec(codec); err != nil {
+			return err
+		}
+		s.codec = codec
+		return nil
+	}
+}
+
+// WithDeltas allows objects to be stored as deltas against other objects, see
+// SetEncodedObjectDelta and DeltifyObjects. Delta chains are limited to
+// maxDepth deltas so that reading an object stays bounded.
+func WithDeltas(maxDepth int) StorageOption {
+	return func(s *FDBStore) error {
+		if maxDepth < 0 {
+			return fmt.Errorf("invalid max delta depth %d", maxDepth)
+		}
+		s.maxDeltaDepth = maxDepth
+		return nil
+	}
+}
+
+// WithChunking stores objects of chunkedObjectMinSize and up as content
+// defined chunks. Chunks are deduplicated across all objects of the repository,
+// so near identical versions of a large file mostly share their chunks.
+func WithChunking() StorageOption {
+	return func(s *FDBStore) error {
+		s.chunking = true
+		return nil
+	}
 }
 
-func NewStorage(log logrus.FieldLogger, db fdb.Database, ns, url string) (*FDBStore, error) {
-	memStore := memory.NewStorage()
+// WithCommitter sets the identity recorded in the reflog for reference changes
+// made without one, such as those done through go-git's storer interfaces.
+func WithCommitter(name, email string) StorageOption {
+	return func(s *FDBStore) error {
+		s.committer = ReflogIdentity{Name: name, Email: email}
+		return nil
+	}
+}
+
+func NewStorage(log logrus.FieldLogger, db fdb.Database, ns, url string, opts ...StorageOption) (*FDBStore, error) {
 	var err error
 	dir, err := directory.CreateOrOpen(db, []string{url}, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	s := &FDBStore{memStore.ModuleStorage, log, db, dir, make(map[string]subspace.Subspace)}
+	scopes, err := directory.CreateOrOpen(db, []string{configScopesDirName}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FDBStore{log: log, db: db, scopes: scopes, tenant: ns, committer: defaultCommitter}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	s.setDirectory(dir)
+	return s, nil
+}
 
+// Roots the store in dir.
+func (s *FDBStore) setDirectory(dir directory.DirectorySubspace) {
+	s.d = dir
+	s.ss = make(map[string]subspace.Subspace)
 	// TODO: subspace this out further ?
 	s.ss[refOpKey] = s.d.Sub(refOpKey)
 	s.ss[objectOpKey] = s.d.Sub(objectOpKey)
-	return s, nil
+	s.ss[stageOpKey] = s.d.Sub(stageOpKey)
+	s.ss[chunkOpKey] = s.d.Sub(chunkOpKey)
+	s.ss[reflogOpKey] = s.d.Sub(reflogOpKey)
+	s.ss[indexDataOpKey] = s.d.Sub(indexDataOpKey)
+	s.ss[refEventOpKey] = s.d.Sub(refEventOpKey)
 }
 
+// Remove deletes everything stored for the repository, including its
+// submodules.
 func (s *FDBStore) Remove() error {
+	if err := s.removeModules(); err != nil {
+		return err
+	}
 	err := clear_subspace(s.db, s.d)
 	return err
 }
@@ -0,0 +1,90 @@
+package fdbstore
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+)
+
+// RefChange is a reference change handed to hooks. Old is nil for a created
+// reference and New is nil for a removed one, names are those of the
+// namespace the change was made in.
+type RefChange struct {
+	Name plumbing.ReferenceName
+	Old  *plumbing.Reference
+	New  *plumbing.Reference
+}
+
+// PreUpdateHook is run inside the transaction of a reference update, before
+// anything is written, with every change of the update. Returning an error
+// rejects the whole update and the error is returned to the caller as is.
+// s is the store the update was made through, so hooks can inspect the objects
+// the new references point to. The transaction may be retried on conflicts, in
+// which case hooks run again.
+type PreUpdateHook func(s *FDBStore, changes []RefChange) error
+
+// PostUpdateHook is run once a reference update is committed, with every
+// change of the update.
+type PostUpdateHook func(s *FDBStore, changes []RefChange)
+
+// WithPreUpdateHook adds a hook run before every reference update, hooks run
+// in the order they're added and the first error stops the update.
+func WithPreUpdateHook(h PreUpdateHook) StorageOption {
+	return func(s *FDBStore) error {
+		s.preUpdateHooks = append(s.preUpdateHooks, h)
+		return nil
+	}
+}
+
+// WithPostUpdateHook adds a hook run after every committed reference update,
+// hooks run in the order they're added.
+func WithPostUpdateHook(h PostUpdateHook) StorageOption {
+	return func(s *FDBStore) error {
+		s.postUpdateHooks = append(s.postUpdateHooks, h)
+		return nil
+	}
+}
+
+// Reads the current value of every reference in updates within an existing
+// transaction and returns the changes the updates make.
+func (s *FDBStore) refChanges(tr fdb.Transaction, updates []ReferenceUpdate) ([]RefChange, error) {
+	changes := make([]RefChange, 0, len(updates))
+	for _, u := range updates {
+		old, err := s.reference(tr, u.Name)
+		if err != nil && err != plumbing.ErrReferenceNotFound {
+			return nil, errors.Wrap(err, "failed to read previous ref")
+		}
+		c := RefChange{Name: u.Name, Old: old}
+		if u.Op != RefDelete {
+			c.New = u.New
+		}
+		if c.Old == nil && c.New == nil {
+			// removing a reference that doesn't exist changes nothing
+			continue
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+func (s *FDBStore) runPreUpdateHooks(changes []RefChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	for _, h := range s.preUpdateHooks {
+		if err := h(s, changes); err != nil {
+			s.log.WithError(err).WithField("changes", len(changes)).Info("ref update rejected by hook")
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FDBStore) runPostUpdateHooks(changes []RefChange) {
+	if len(changes) == 0 {
+		return
+	}
+	for _, h := range s.postUpdateHooks {
+		h(s, changes)
+	}
+}
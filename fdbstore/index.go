@@ -2,39 +2,408 @@ package fdbstore
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
 	"github.com/go-git/go-git/v5/plumbing/format/index"
 	"github.com/pkg/errors"
 )
 
+const (
+	// Number of index entries written or read per transaction.
+	indexBatch = 1000
+	// Number of times reading the index is restarted when a new index is
+	// stored while it's being read.
+	indexReadRetries = 3
+)
+
+// Keys of the index extensions stored next to the entries.
+const (
+	indexExtTree        = "tree"
+	indexExtResolveUndo = "resolve-undo"
+	indexExtEOIE        = "eoie"
+)
+
+var (
+	ErrIndexChanged = fmt.Errorf("index was replaced while being written")
+	errIndexMoved   = fmt.Errorf("index was replaced while being read")
+)
+
+// The index is stored a key per entry, ordered by path and stage, with the
+// extensions in values of their own, chunked when big, see writeValue. Each
+// index stored with SetIndex is a new generation, written over as many
+// transactions as it takes and made current in a final transaction that also
+// removes the previous generation. Until then the generation has a pending
+// marker, which is gone if a concurrent SetIndex won the race. Generations
+// left behind by failed writes are removed by the next SetIndex. Indexes
+// written before were a single JSON value, they're read until the first
+// SetIndex. Partial updates change the current generation in place and bump
+// its update counter, reads spanning transactions restart when it moves.
+
+// indexVersion identifies a state of the index, its generation and the update
+// counter of the generation.
+type indexVersion struct {
+	gen     string
+	updates string
+}
+
+// indexMeta holds the header fields of an index.
+type indexMeta struct {
+	Version uint32
+}
+
+// Index reads the whole index, a page of entries per transaction. A missing
+// index is an empty one.
 func (s *FDBStore) Index() (*index.Index, error) {
-	ret, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
-		ret = tr.Get(fdb.Key(s.genIndexKey())).MustGet()
+	for attempt := 0; ; attempt++ {
+		i, err := s.readIndex()
+		if err != errIndexMoved || attempt == indexReadRetries {
+			return i, err
+		}
+		s.log.Debug("index replaced while reading, retrying")
+	}
+}
+
+func (s *FDBStore) readIndex() (*index.Index, error) {
+	i := &index.Index{Version: 2}
+	var v indexVersion
+	_, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
+		v = s.readIndexVersion(tr)
+		gen := v.gen
+		if gen == "" {
+			return nil, s.readLegacyIndex(tr, i)
+		}
+		meta := tr.Get(s.genIndexMetaKey(gen))
+		exts := map[string]interface{}{
+			indexExtTree:        &i.Cache,
+			indexExtResolveUndo: &i.ResolveUndo,
+			indexExtEOIE:        &i.EndOfIndexEntry,
+		}
+		futures := make(map[string]fdb.FutureByteSlice, len(exts))
+		for ext := range exts {
+			futures[ext] = tr.Get(s.genIndexExtKey(gen, ext))
+		}
+		m := new(indexMeta)
+		if err := json.Unmarshal(meta.MustGet(), m); err != nil {
+			return nil, errors.Wrap(err, "failed to decode index header")
+		}
+		i.Version = m.Version
+		for ext, v := range exts {
+			b, err := s.resolveValue(tr, s.genIndexExtKey(gen, ext), futures[ext].MustGet())
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read index %s extension", ext)
+			}
+			if len(b) == 0 {
+				continue
+			}
+			if err := json.Unmarshal(b, v); err != nil {
+				return nil, errors.Wrapf(err, "failed to decode index %s extension", ext)
+			}
+		}
 		return
 	})
+	if err != nil || v.gen == "" {
+		return i, err
+	}
+	i.Entries, err = s.readIndexEntries(v, "")
 	if err != nil {
 		return nil, err
 	}
-	i := new(index.Index)
-	if err = json.Unmarshal(ret.([]byte), i); err != nil {
+	return i, nil
+}
+
+func (s *FDBStore) readLegacyIndex(tr fdb.ReadTransaction, i *index.Index) error {
+	b, err := s.readValue(tr, s.genIndexKey())
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(b, i); err != nil {
 		s.log.WithError(err).Error("failed to unmarshal index")
+		return err
+	}
+	return nil
+}
+
+// IndexEntries returns the entries of the index whose path starts with
+// prefix, in path order.
+func (s *FDBStore) IndexEntries(prefix string) ([]*index.Entry, error) {
+	for attempt := 0; ; attempt++ {
+		v, err := s.currentIndexVersion()
+		if err != nil || v.gen == "" {
+			return nil, err
+		}
+		entries, err := s.readIndexEntries(v, prefix)
+		if err != errIndexMoved || attempt == indexReadRetries {
+			return entries, err
+		}
 	}
-	return i, err
 }
 
+// Reads the entries of index version v with paths starting with prefix, failing
+// with errIndexMoved if the index changes in the meantime.
+func (s *FDBStore) readIndexEntries(v indexVersion, prefix string) ([]*index.Entry, error) {
+	kr, err := stringPrefixRange(s.ss[indexDataOpKey].Sub(v.gen, "entry"), prefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to configure index entry range")
+	}
+	entries := make([]*index.Entry, 0)
+	for {
+		ret, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
+			if s.readIndexVersion(tr) != v {
+				return nil, errIndexMoved
+			}
+			ret, e = tr.GetRange(kr, fdb.RangeOptions{Limit: indexBatch}).GetSliceWithError()
+			return
+		})
+		if err != nil {
+			return nil, err
+		}
+		kvs := ret.([]fdb.KeyValue)
+		for _, kv := range kvs {
+			e := new(index.Entry)
+			if err := json.Unmarshal(kv.Value, e); err != nil {
+				return nil, errors.Wrap(err, "failed to decode index entry")
+			}
+			entries = append(entries, e)
+		}
+		if len(kvs) < indexBatch {
+			return entries, nil
+		}
+		kr.Begin = append(append(fdb.Key{}, kvs[len(kvs)-1].Key...), 0x00)
+	}
+}
+
+// SetIndex replaces the index, see the layout above. If another SetIndex
+// replaces the index while this one is being written ErrIndexChanged is
+// returned and the index is the other one.
 func (s *FDBStore) SetIndex(i *index.Index) error {
-	payload, err := json.Marshal(i)
+	gen, err := newStageID()
+	if err != nil {
+		return err
+	}
+	meta, err := json.Marshal(indexMeta{Version: i.Version})
 	if err != nil {
-		return errors.Wrap(err, "failed to encode index")
+		return errors.Wrap(err, "failed to encode index header")
+	}
+	exts := map[string]interface{}{}
+	if i.Cache != nil {
+		exts[indexExtTree] = i.Cache
+	}
+	if i.ResolveUndo != nil {
+		exts[indexExtResolveUndo] = i.ResolveUndo
 	}
+	if i.EndOfIndexEntry != nil {
+		exts[indexExtEOIE] = i.EndOfIndexEntry
+	}
+	extValues := make(map[string][]byte, len(exts))
+	for ext, v := range exts {
+		if extValues[ext], err = json.Marshal(v); err != nil {
+			return errors.Wrapf(err, "failed to encode index %s extension", ext)
+		}
+	}
+
 	_, err = s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
-		tr.Set(s.genIndexKey(), payload)
+		tr.Set(s.genIndexPendingKey(gen), []byte{1})
+		tr.Set(s.genIndexMetaKey(gen), meta)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	// extensions such as the tree cache can outgrow a single value
+	for ext, v := range extValues {
+		err := s.writeValue(s.genIndexExtKey(gen, ext), v, func(tr fdb.Transaction) error {
+			return s.checkIndexPending(tr, gen)
+		})
+		if err == ErrValueChanged {
+			err = ErrIndexChanged
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	entries := i.Entries
+	for {
+		n := len(entries)
+		if n > indexBatch {
+			n = indexBatch
+		}
+		batch := entries[:n]
+		last := n == len(entries)
+		_, err := s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+			if err := s.checkIndexPending(tr, gen); err != nil {
+				return nil, err
+			}
+			if err := s.setIndexEntries(tr, gen, batch); err != nil {
+				return nil, err
+			}
+			if last {
+				return nil, s.commitIndexGen(tr, gen)
+			}
+			return
+		})
+		if err != nil {
+			return err
+		}
+		if last {
+			break
+		}
+		entries = entries[n:]
+	}
+	s.log.WithField("entries", len(i.Entries)).WithField("gen", gen).Debug("stored index")
+	return nil
+}
+
+// Makes gen the current index generation and removes all others, within the
+// final transaction writing it.
+func (s *FDBStore) commitIndexGen(tr fdb.Transaction, gen string) error {
+	if err := s.checkIndexPending(tr, gen); err != nil {
+		return err
+	}
+	tr.Clear(s.genIndexPendingKey(gen))
+	tr.Set(s.genIndexGenKey(), []byte(gen))
+	tr.Clear(s.genIndexKey())
+
+	begin, end := s.ss[indexDataOpKey].FDBRangeKeys()
+	genBegin, genEnd := s.ss[indexDataOpKey].Sub(gen).FDBRangeKeys()
+	tr.ClearRange(fdb.KeyRange{Begin: begin, End: genBegin})
+	tr.ClearRange(fdb.KeyRange{Begin: genEnd, End: end})
+	return nil
+}
+
+// Fails with ErrIndexChanged once the generation gen was removed by a
+// concurrent SetIndex.
+func (s *FDBStore) checkIndexPending(tr fdb.Transaction, gen string) error {
+	if len(tr.Get(s.genIndexPendingKey(gen)).MustGet()) == 0 {
+		return ErrIndexChanged
+	}
+	return nil
+}
+
+// SetIndexEntries adds or replaces the given entries of the current index in a
+// single transaction, entries are matched by path and stage. The cache tree
+// extension is dropped as it no longer matches the entries.
+func (s *FDBStore) SetIndexEntries(entries ...*index.Entry) error {
+	return s.updateIndex(func(tr fdb.Transaction, gen string) error {
+		return s.setIndexEntries(tr, gen, entries)
+	})
+}
+
+// RemoveIndexEntries removes every stage of the given paths from the current
+// index in a single transaction. The cache tree extension is dropped as it no
+// longer matches the entries.
+func (s *FDBStore) RemoveIndexEntries(paths ...string) error {
+	return s.updateIndex(func(tr fdb.Transaction, gen string) error {
+		for _, p := range paths {
+			begin, end := s.ss[indexDataOpKey].Sub(gen, "entry", p).FDBRangeKeys()
+			tr.ClearRange(fdb.KeyRange{Begin: begin, End: end})
+		}
+		return nil
+	})
+}
+
+// Runs fn on the current index generation in one transaction, bumping its
+// update counter and dropping its cache tree. An index still in the legacy
+// format is converted first.
+func (s *FDBStore) updateIndex(fn func(tr fdb.Transaction, gen string) error) error {
+	v, err := s.currentIndexVersion()
+	if err != nil {
+		return err
+	}
+	if v.gen == "" {
+		i, err := s.Index()
+		if err != nil {
+			return err
+		}
+		if err := s.SetIndex(i); err != nil {
+			return err
+		}
+	}
+	_, err = s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+		gen := string(tr.Get(s.genIndexGenKey()).MustGet())
+		if gen == "" {
+			return nil, ErrIndexChanged
+		}
+		if err := fn(tr, gen); err != nil {
+			return nil, err
+		}
+		tree := s.genIndexExtKey(gen, indexExtTree)
+		begin, end := subspace.FromBytes(tree).FDBRangeKeys()
+		tr.Clear(tree)
+		tr.ClearRange(fdb.KeyRange{Begin: begin, End: end})
+		addKey(tr, s.genIndexUpdatesKey(gen), 1)
 		return
 	})
 	return err
 }
 
+func (s *FDBStore) setIndexEntries(tr fdb.Transaction, gen string, entries []*index.Entry) error {
+	for _, e := range entries {
+		v, err := json.Marshal(e)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode index entry")
+		}
+		tr.Set(s.genIndexEntryKey(gen, e), v)
+	}
+	return nil
+}
+
+func (s *FDBStore) currentIndexVersion() (indexVersion, error) {
+	ret, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
+		ret = s.readIndexVersion(tr)
+		return
+	})
+	if err != nil {
+		return indexVersion{}, err
+	}
+	return ret.(indexVersion), nil
+}
+
+func (s *FDBStore) readIndexVersion(tr fdb.ReadTransaction) indexVersion {
+	gen := string(tr.Get(s.genIndexGenKey()).MustGet())
+	if gen == "" {
+		return indexVersion{}
+	}
+	return indexVersion{gen: gen, updates: string(tr.Get(s.genIndexUpdatesKey(gen)).MustGet())}
+}
+
+// key = dir[url]/tuple[index], the legacy JSON index
 func (s *FDBStore) genIndexKey() fdb.Key {
 	return s.genStorageKey(indexOpKey)
 }
+
+// key = dir[url]/tuple[index-gen]
+func (s *FDBStore) genIndexGenKey() fdb.Key {
+	return s.genStorageKey("index-gen")
+}
+
+// key = dir[url]/sub[idx]/tuple[gen, meta]
+func (s *FDBStore) genIndexMetaKey(gen string) fdb.Key {
+	return s.ss[indexDataOpKey].Pack(tuple.Tuple{gen, "meta"})
+}
+
+// key = dir[url]/sub[idx]/tuple[gen, pending]
+func (s *FDBStore) genIndexPendingKey(gen string) fdb.Key {
+	return s.ss[indexDataOpKey].Pack(tuple.Tuple{gen, "pending"})
+}
+
+// key = dir[url]/sub[idx]/tuple[gen, updates]
+func (s *FDBStore) genIndexUpdatesKey(gen string) fdb.Key {
+	return s.ss[indexDataOpKey].Pack(tuple.Tuple{gen, "updates"})
+}
+
+// key = dir[url]/sub[idx]/tuple[gen, ext, extension]
+func (s *FDBStore) genIndexExtKey(gen, ext string) fdb.Key {
+	return s.ss[indexDataOpKey].Pack(tuple.Tuple{gen, "ext", ext})
+}
+
+// key = dir[url]/sub[idx]/tuple[gen, entry, path, stage]
+func (s *FDBStore) genIndexEntryKey(gen string, e *index.Entry) fdb.Key {
+	return s.ss[indexDataOpKey].Pack(tuple.Tuple{gen, "entry", e.Name, int64(e.Stage)})
+}
@@ -0,0 +1,45 @@
+package fdbstore
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/pkg/errors"
+)
+
+// Name of the directory, nested in the repository's, holding the directories
+// of its submodules.
+const moduleDirName = "modules"
+
+// Module returns the storer of the submodule name. It's an FDBStore of its own
+// rooted in a directory nested in the repository's, so its objects, references
+// and config persist and are removed along with the repository. The submodule
+// store is configured like its parent, apart from the namespace and hooks
+// which only apply to the parent.
+func (s *FDBStore) Module(name string) (storage.Storer, error) {
+	dir, err := s.d.CreateOrOpen(s.db, []string{moduleDirName, name}, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open directory of module %s", name)
+	}
+	m := &FDBStore{
+		log:           s.log.WithField("module", name),
+		db:            s.db,
+		codec:         s.codec,
+		maxDeltaDepth: s.maxDeltaDepth,
+		chunking:      s.chunking,
+		scopes:        s.scopes,
+		tenant:        s.tenant,
+		committer:     s.committer,
+	}
+	m.setDirectory(dir)
+	return m, nil
+}
+
+// Removes the directories of all submodules, and with them their own
+// submodules.
+func (s *FDBStore) removeModules() error {
+	_, err := s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+		_, e = s.d.Remove(tr, []string{moduleDirName})
+		return
+	})
+	return errors.Wrap(err, "failed to remove module directories")
+}
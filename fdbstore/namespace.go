@@ -0,0 +1,88 @@
+package fdbstore
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Namespaces partition references the way GIT_NAMESPACE does, the references of
+// namespace foo are stored as refs/namespaces/foo/<name>, and a/b nests b in a.
+// Objects aren't namespaced, every namespace shares the object store.
+const namespaceRefPrefix = "refs/namespaces/"
+
+var ErrInvalidNamespace = fmt.Errorf("invalid namespace")
+
+// WithNamespace selects the namespace all reference APIs operate in.
+func WithNamespace(ns string) StorageOption {
+	return func(s *FDBStore) error {
+		prefix, err := namespacePrefix(ns)
+		if err != nil {
+			return err
+		}
+		s.refPrefix = prefix
+		return nil
+	}
+}
+
+// Namespace returns a view of the store whose reference APIs operate in
+// namespace ns, an empty ns selects the root namespace which sees the
+// references of all namespaces under refs/namespaces/. It replaces any
+// namespace s already selected, the view shares everything else with s.
+func (s *FDBStore) Namespace(ns string) (*FDBStore, error) {
+	prefix, err := namespacePrefix(ns)
+	if err != nil {
+		return nil, err
+	}
+	view := *s
+	view.refPrefix = prefix
+	return &view, nil
+}
+
+func namespacePrefix(ns string) (string, error) {
+	if ns == "" {
+		return "", nil
+	}
+	var b strings.Builder
+	for _, c := range strings.Split(ns, "/") {
+		if c == "" || c == "." || c == ".." || strings.ContainsAny(c, " ~^:?*[\\\x00") {
+			return "", fmt.Errorf("%w: %q", ErrInvalidNamespace, ns)
+		}
+		b.WriteString(namespaceRefPrefix + c + "/")
+	}
+	return b.String(), nil
+}
+
+// Returns the full name of n in the selected namespace.
+func (s *FDBStore) nsRefName(n plumbing.ReferenceName) plumbing.ReferenceName {
+	return plumbing.ReferenceName(s.refPrefix + n.String())
+}
+
+// Returns r with its name, and target if it's symbolic, moved into the
+// selected namespace.
+func (s *FDBStore) nsRef(r *plumbing.Reference) *plumbing.Reference {
+	if s.refPrefix == "" {
+		return r
+	}
+	if r.Type() == plumbing.SymbolicReference {
+		return plumbing.NewSymbolicReference(s.nsRefName(r.Name()), s.nsRefName(r.Target()))
+	}
+	return plumbing.NewHashReference(s.nsRefName(r.Name()), r.Hash())
+}
+
+func (s *FDBStore) stripNamespaceName(n plumbing.ReferenceName) plumbing.ReferenceName {
+	return plumbing.ReferenceName(strings.TrimPrefix(n.String(), s.refPrefix))
+}
+
+// Returns r as seen from the selected namespace, the inverse of nsRef. Targets
+// of symbolic references outside the namespace are kept as they are.
+func (s *FDBStore) stripNamespace(r *plumbing.Reference) *plumbing.Reference {
+	if s.refPrefix == "" {
+		return r
+	}
+	if r.Type() == plumbing.SymbolicReference {
+		return plumbing.NewSymbolicReference(s.stripNamespaceName(r.Name()), s.stripNamespaceName(r.Target()))
+	}
+	return plumbing.NewHashReference(s.stripNamespaceName(r.Name()), r.Hash())
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"time"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
@@ -22,19 +21,37 @@ const ObjectChunkSize = 10000
 
 var ErrUnsupportedObjectType = fmt.Errorf("unsupported object type")
 
-// Temporarily uses a plumbing.MemoryObject, but should be replaced with a
-// with a bespoke EncodedObject implementation later.
+// Returns an FDBObject that streams its content into FDB as it's written.
 func (s *FDBStore) NewEncodedObject() plumbing.EncodedObject {
-	return &plumbing.MemoryObject{}
+	return &FDBObject{s: s, codec: s.codec}
 }
 
 type ObjectHeader struct {
 	Type plumbing.ObjectType
+	// Size is the uncompressed size of the object.
 	Size int64
+	// Codec is the ChunkCodec the object parts were compressed with, empty for
+	// uncompressed parts.
+	Codec string `json:",omitempty"`
+	// Parts is the number of parts the object is stored in. Objects written
+	// before it was recorded have it derived from their size.
+	Parts int `json:",omitempty"`
+	// Chunks is set for objects stored as content defined chunks, the parts
+	// then hold a manifest of that many chunks.
+	Chunks int `json:",omitempty"`
+	// Stage is the id of the staging area holding the object's parts, empty
+	// when the parts are keyed by the object hash.
+	Stage string `json:",omitempty"`
+	// Delta is set when the parts hold a delta against another object rather
+	// than the object content.
+	Delta *DeltaHeader `json:",omitempty"`
 }
 
 // Store an EncodedObject in the FDBStore returning the Hash of the object and an error if any.
 func (s *FDBStore) SetEncodedObject(o plumbing.EncodedObject) (plumbing.Hash, error) {
+	if fo, ok := o.(*FDBObject); ok && fo.s == s {
+		return storeFDBObject(s, fo)
+	}
 	h := o.Hash()
 	if err := storeObject(s, o); err != nil {
 		return plumbing.ZeroHash, err
@@ -42,54 +59,245 @@ func (s *FDBStore) SetEncodedObject(o plumbing.EncodedObject) (plumbing.Hash, er
 	return h, nil
 }
 
-// Split object into chunks of size ObjectChunkSize and store in the FDBStore.
-func storeObject(s *FDBStore, o plumbing.EncodedObject) error {
-	_, err := s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
-		l := s.log.WithFields(logrus.Fields{"type": o.Type(), "hash": o.Hash(), "full_size": o.Size()})
-		reader, err := o.Reader()
+// Store an FDBObject created by this store. Objects that never spilled into a
+// staging area are stored like any other object, otherwise the remaining
+// buffered chunks and the header pointing at the stage are written in a final
+// transaction.
+func storeFDBObject(s *FDBStore, o *FDBObject) (plumbing.Hash, error) {
+	if o.header != nil {
+		return o.h, nil
+	}
+	if o.written != o.sz {
+		o.sz = o.written
+		o.hasher = nil
+	}
+	h := o.Hash()
+	if s.chunking && o.sz >= chunkedObjectMinSize {
+		header, err := storeChunkedObject(s, o)
 		if err != nil {
 			return plumbing.ZeroHash, err
 		}
-		defer ioutil.CheckClose(reader, &err)
-		r := bufio.NewReader(reader)
-		buf := make([]byte, 0, ObjectChunkSize)
-
-		part := 0
-		for {
-			pl := l.WithField("part", part)
-
-			//read up to 10k bytes from the object into the read buffer
-			n, err := io.ReadFull(r, buf[:cap(buf)])
-			buf = buf[:n]
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				if err != io.ErrUnexpectedEOF {
-					return plumbing.ZeroHash, err
-				}
+		if o.stage != "" {
+			// the chunks hold their own copy of the content
+			if err := s.dropStage(o.stage); err != nil {
+				return plumbing.ZeroHash, err
 			}
-			tr.Set(s.genObjectPartKey(o.Hash(), part), buf)
-			pl.WithField("size", n).Debug("stored part")
-			part++
 		}
+		o.header = header
+		o.buf = nil
+		return h, nil
+	}
+	if o.stage == "" {
+		if err := storeObject(s, o); err != nil {
+			return plumbing.ZeroHash, err
+		}
+		o.header = &ObjectHeader{Type: o.t, Size: o.sz, Codec: s.codec, Parts: partCount(o.sz)}
+		o.buf = nil
+		return h, nil
+	}
+
+	header, _, err := s.commitStaged(h, o, ObjectHeader{Type: o.t, Size: o.sz, Codec: o.codec})
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	o.header = header
+	o.buf = nil
+	return h, nil
+}
 
-		header := ObjectHeader{
-			Type: o.Type(),
-			Size: o.Size(),
+// Commits the parts o has written as the parts of object h. The chunks still
+// buffered and the header are written in one transaction, together with
+// clearing the stage's pending marker. Parts that never spilled into a stage
+// are keyed by hash. If h is already stored the staged copy is dropped and the
+// existing header returned, along with dup set.
+func (s *FDBStore) commitStaged(h plumbing.Hash, o *FDBObject, header ObjectHeader) (*ObjectHeader, bool, error) {
+	tail, err := encodeParts(o.codec, o.buf)
+	if err != nil {
+		return nil, false, err
+	}
+	header.Parts = o.parts + len(tail)
+	header.Stage = o.stage
+	payload, err := json.Marshal(header)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to encode object header for storage")
+	}
+	existing, err := s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+		if o.stage != "" {
+			if err := s.checkStagePending(tr, o.stage); err != nil {
+				return nil, err
+			}
+			tr.Clear(s.genStagePendingKey(o.stage))
 		}
-		payload, err := json.Marshal(header)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to encode object header for storage")
+		ret = tr.Get(s.genObjectMetaKey(h, "header")).MustGet()
+		if !isNilKey(ret) {
+			// already stored, drop the duplicate content
+			if o.stage != "" {
+				tr.ClearRange(s.ss[stageOpKey].Sub(o.stage))
+			}
+			return
+		}
+		for i, p := range tail {
+			tr.Set(s.objectPartKey(h, &header, o.parts+i), p)
+		}
+		tr.Set(s.genObjectMetaKey(h, "header"), payload)
+		tr.Set(s.genObjectMetaKeyByType(header.Type, h, "header"), payload)
+		return nil, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if !isNilKey(existing) {
+		stored := new(ObjectHeader)
+		if err := json.Unmarshal(existing.([]byte), stored); err != nil {
+			return nil, false, errors.Wrap(err, "failed to decode object header")
 		}
-		tr.Set(s.genObjectMetaKey(o.Hash(), "header"), payload)
-		tr.Set(s.genObjectMetaKeyByType(o.Type(), o.Hash(), "header"), payload)
-		l.Debug("stored header object")
+		s.log.WithFields(logrus.Fields{"type": header.Type, "hash": h}).Debug("object already stored, dropped staged copy")
+		return stored, true, nil
+	}
+	s.log.WithFields(logrus.Fields{"type": header.Type, "hash": h, "stage": o.stage}).Debug("stored staged object")
+	return &header, false, nil
+}
+
+// Copy an object too big for a single transaction into a staging area, the
+// object only becomes visible once its header is committed.
+func storeStagedObject(s *FDBStore, o plumbing.EncodedObject) (err error) {
+	fo := &FDBObject{s: s, t: o.Type(), codec: s.codec}
+	reader, err := o.Reader()
+	if err != nil {
+		return err
+	}
+	defer ioutil.CheckClose(reader, &err)
+	if _, err = io.Copy(&objectWriter{fo}, reader); err != nil {
+		return err
+	}
+	fo.sz = fo.written
+	fo.h = o.Hash()
+	_, err = storeFDBObject(s, fo)
+	return err
+}
+
+// Split object into chunks of size ObjectChunkSize and store in the FDBStore.
+// Objects bigger than maxInlineObjectSize are staged across transactions.
+func storeObject(s *FDBStore, o plumbing.EncodedObject) error {
+	if s.chunking && o.Size() >= chunkedObjectMinSize {
+		_, err := storeChunkedObject(s, o)
+		return err
+	}
+	if o.Size() > maxInlineObjectSize {
+		return storeStagedObject(s, o)
+	}
+	p, err := prepareObject(s, o)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+		s.writePreparedObject(tr, p)
 		return nil, nil
 	})
 	return err
 }
 
+// An object read into its compressed parts, ready to be written in a
+// transaction.
+type preparedObject struct {
+	h       plumbing.Hash
+	t       plumbing.ObjectType
+	parts   [][]byte
+	payload []byte
+}
+
+func prepareObject(s *FDBStore, o plumbing.EncodedObject) (*preparedObject, error) {
+	parts, err := readObjectParts(o, s.codec)
+	if err != nil {
+		return nil, err
+	}
+	header := ObjectHeader{
+		Type:  o.Type(),
+		Size:  o.Size(),
+		Codec: s.codec,
+		Parts: len(parts),
+	}
+	payload, err := json.Marshal(header)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode object header for storage")
+	}
+	return &preparedObject{h: o.Hash(), t: o.Type(), parts: parts, payload: payload}, nil
+}
+
+// Number of bytes the object adds to a transaction.
+func (p *preparedObject) size() int {
+	n := 2 * len(p.payload)
+	for _, part := range p.parts {
+		n += len(part)
+	}
+	return n
+}
+
+func (s *FDBStore) writePreparedObject(tr fdb.Transaction, p *preparedObject) {
+	l := s.log.WithFields(logrus.Fields{"type": p.t, "hash": p.h})
+	for part, c := range p.parts {
+		tr.Set(s.genObjectPartKey(p.h, part), c)
+		l.WithField("part", part).WithField("size", len(c)).Debug("stored part")
+	}
+	tr.Set(s.genObjectMetaKey(p.h, "header"), p.payload)
+	tr.Set(s.genObjectMetaKeyByType(p.t, p.h, "header"), p.payload)
+	l.Debug("stored header object")
+}
+
+// Reads an object into chunks of ObjectChunkSize compressed with codec. This
+// happens outside of the transaction so a retried transaction doesn't have
+// to reread the object.
+func readObjectParts(o plumbing.EncodedObject, codec string) (parts [][]byte, err error) {
+	reader, err := o.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer ioutil.CheckClose(reader, &err)
+	r := bufio.NewReader(reader)
+	for {
+		//read up to 10k bytes from the object into the read buffer
+		buf := make([]byte, ObjectChunkSize)
+		n, err := io.ReadFull(r, buf)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if err != io.ErrUnexpectedEOF {
+				return nil, err
+			}
+		}
+		p, err := encodeChunk(codec, buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+	return parts, nil
+}
+
+func (h *ObjectHeader) partCount() int {
+	if h.Parts > 0 {
+		return h.Parts
+	}
+	return partCount(h.partsSize())
+}
+
+// Size of the data held in the object parts.
+func (h *ObjectHeader) partsSize() int64 {
+	switch {
+	case h.Delta != nil:
+		return h.Delta.Size
+	case h.Chunks > 0:
+		return int64(h.Chunks * chunkRecordSize)
+	}
+	return h.Size
+}
+
+// Number of ObjectChunkSize parts size bytes are split into.
+func partCount(size int64) int {
+	return int((size + ObjectChunkSize - 1) / ObjectChunkSize)
+}
+
 func (s *FDBStore) HasEncodedObject(h plumbing.Hash) error {
 	_, err := s.hasEncodedObject(h)
 	return err
@@ -135,91 +343,31 @@ func (s *FDBStore) EncodedObjectSize(h plumbing.Hash) (size int64, err error) {
 }
 
 func (s *FDBStore) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
-	if err := s.HasEncodedObject(h); err != nil {
-		return nil, err
-	}
 	return s.getEncodedObject(t, h)
 }
 
-// TODO: redo using prefix query using FDBRangeKeys
+// Fetches only the object header, the returned FDBObject streams the object
+// parts when its Reader is consumed.
 func (s *FDBStore) getEncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
-	o := s.NewEncodedObject()
-	o.SetType(t)
-	_, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
-		header := new(ObjectHeader)
-		ret = tr.Get(s.genObjectMetaKey(h, "header")).MustGet()
-		if isNilKey(ret) {
-			s.log.WithField("hash", h).WithField("type", t).Warn("object header not found on attempted get")
-			return nil, plumbing.ErrObjectNotFound
-		}
-		if err := json.Unmarshal(ret.([]byte), header); err != nil {
-			return nil, errors.Wrap(err, "failed to unmarshal object header")
-		}
-		o.SetSize(header.Size)
-		for i := 0; i < int(header.Size/10000)+1; i++ {
-			ret := tr.Get(s.genObjectPartKey(h, i)).MustGet()
-			if isNilKey(ret) {
-				s.log.WithField("part", i).WithField("hash", h).Warn("part not found")
-				return nil, plumbing.ErrObjectNotFound
-			}
-			w, err := o.Writer()
-			if err != nil {
-				return nil, err
-			}
-			w.Write(ret)
-		}
-		return nil, nil
-	})
-	return o, err
-}
-
-// TODO: optimize, this is functional but slow and wasteful
-func (s *FDBStore) IterEncodedObjects(t plumbing.ObjectType) (storer.EncodedObjectIter, error) {
-	s.log.Warn("IterEncodedObjects not implemented")
-	var series []plumbing.EncodedObject
-
-	if t == plumbing.AnyObject {
-		return nil, errors.New("IterEncodedObjects not implemented for AnyObject")
-	}
-
-	matchedHashes, err := s.getMetaByType(t)
+	header, err := s.hasEncodedObject(h)
 	if err != nil {
 		return nil, err
 	}
-	series = make([]plumbing.EncodedObject, len(matchedHashes))
-	for _, h := range matchedHashes {
-		o, err := s.getEncodedObject(t, h)
-		if err != nil {
-			return nil, err
-		}
-		series = append(series, o)
+	if t != plumbing.AnyObject && header.Type != t {
+		s.log.WithField("hash", h).WithField("type", t).Warn("object type mismatch on attempted get")
+		return nil, plumbing.ErrObjectNotFound
 	}
-	return storer.NewEncodedObjectSliceIter(series), nil
+	return newFDBObject(s, h, header), nil
 }
 
-func (s *FDBStore) getMetaByType(t plumbing.ObjectType) ([]plumbing.Hash, error) {
-	ret, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
-		start, err := fdb.PrefixRange(s.ss[objectOpKey].Pack(tuple.Tuple{t.String()}))
-		if err != nil {
-			log.Fatal(err)
-		}
-		ret, e = tr.GetRange(start, fdb.RangeOptions{Mode: fdb.StreamingModeWantAll}).GetSliceWithError()
-		if e != nil {
-			log.Fatal(err)
-		}
-		return
-	})
-	if err != nil {
-		return nil, err
-	}
-	if isNilKey(ret) {
-		return nil, nil
-	}
-	hashes := make([]plumbing.Hash, 0, len(ret.([]fdb.KeyValue)))
-	for _, kv := range ret.([]fdb.KeyValue) {
-		hashes = append(hashes, plumbing.NewHash(kv.Key.String()[len(s.ss[objectOpKey].Pack(tuple.Tuple{t.String()}))+1:]))
+// Returns an iterator over all objects of the given type, AnyObject walks the
+// type index of every stored object type in turn rather than the hash keyed
+// subspace, which interleaves object headers with their parts.
+func (s *FDBStore) IterEncodedObjects(t plumbing.ObjectType) (storer.EncodedObjectIter, error) {
+	if t == plumbing.AnyObject {
+		return newObjectIter(s, storedObjectTypes), nil
 	}
-	return hashes, nil
+	return newObjectIter(s, []plumbing.ObjectType{t}), nil
 }
 
 func (s *FDBStore) ObjectPacks() ([]plumbing.Hash, error) {
@@ -255,3 +403,12 @@ func (s *FDBStore) genObjectMetaKeyByType(t plumbing.ObjectType, h plumbing.Hash
 func (s *FDBStore) genObjectPartKey(h plumbing.Hash, part int) fdb.Key {
 	return s.ss[objectOpKey].Pack(tuple.Tuple{h.String(), "part", part})
 }
+
+// Returns the key of an object part, which lives in the object's staging area
+// if it was streamed in through an FDBObject writer.
+func (s *FDBStore) objectPartKey(h plumbing.Hash, header *ObjectHeader, part int) fdb.Key {
+	if header.Stage != "" {
+		return s.genStagePartKey(header.Stage, part)
+	}
+	return s.genObjectPartKey(h, part)
+}
@@ -0,0 +1,94 @@
+package fdbstore
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Number of object headers read per transaction in batch lookups.
+	headerBatchSize = 1000
+	// Number of header batch transactions kept in flight at once.
+	headerBatchConcurrency = 4
+)
+
+// MissingEncodedObjects returns the hashes in hashes that aren't stored. All
+// lookups of a batch are issued at once in a single read transaction and large
+// inputs are split into batches that run concurrently.
+func (s *FDBStore) MissingEncodedObjects(hashes []plumbing.Hash) ([]plumbing.Hash, error) {
+	values, err := s.objectHeaderValues(hashes)
+	if err != nil {
+		return nil, err
+	}
+	var missing []plumbing.Hash
+	for i, v := range values {
+		if isNilKey(v) {
+			missing = append(missing, hashes[i])
+		}
+	}
+	s.log.WithField("checked", len(hashes)).WithField("missing", len(missing)).Debug("checked objects")
+	return missing, nil
+}
+
+// Fetches the headers of the given objects, failing if any of them is missing.
+func (s *FDBStore) objectHeaders(hashes []plumbing.Hash) (map[plumbing.Hash]*ObjectHeader, error) {
+	values, err := s.objectHeaderValues(hashes)
+	if err != nil {
+		return nil, err
+	}
+	headers := make(map[plumbing.Hash]*ObjectHeader, len(hashes))
+	for i, v := range values {
+		if isNilKey(v) {
+			return nil, errors.Wrap(plumbing.ErrObjectNotFound, hashes[i].String())
+		}
+		header := new(ObjectHeader)
+		if err := json.Unmarshal(v, header); err != nil {
+			return nil, errors.Wrap(err, "failed to decode object header")
+		}
+		headers[hashes[i]] = header
+	}
+	return headers, nil
+}
+
+// Reads the raw header of every object in hashes, nil for missing objects.
+func (s *FDBStore) objectHeaderValues(hashes []plumbing.Hash) ([][]byte, error) {
+	values := make([][]byte, len(hashes))
+	errs := make(chan error, (len(hashes)+headerBatchSize-1)/headerBatchSize)
+	sem := make(chan struct{}, headerBatchConcurrency)
+	var wg sync.WaitGroup
+	for start := 0; start < len(hashes); start += headerBatchSize {
+		end := start + headerBatchSize
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(batch []plumbing.Hash, out [][]byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			_, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
+				futures := make([]fdb.FutureByteSlice, len(batch))
+				for i, h := range batch {
+					futures[i] = tr.Get(s.genObjectMetaKey(h, "header"))
+				}
+				for i, f := range futures {
+					out[i] = f.MustGet()
+				}
+				return
+			})
+			if err != nil {
+				errs <- err
+			}
+		}(hashes[start:end], values[start:end])
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, errors.Wrap(err, "failed to read object headers")
+	}
+	return values, nil
+}
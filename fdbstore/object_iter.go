@@ -0,0 +1,120 @@
+package fdbstore
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/pkg/errors"
+)
+
+// Number of object headers fetched per transaction while iterating.
+const objectIterBatch = 500
+
+// Object types walked when iterating over plumbing.AnyObject.
+var storedObjectTypes = []plumbing.ObjectType{
+	plumbing.CommitObject,
+	plumbing.TreeObject,
+	plumbing.BlobObject,
+	plumbing.TagObject,
+}
+
+// objectIter walks the type index of one or more object types, reading a page
+// of headers per transaction. Objects are only decoded when Next reaches them
+// and their content is streamed lazily like any other FDBObject.
+type objectIter struct {
+	s     *FDBStore
+	types []plumbing.ObjectType
+
+	sub   subspace.Subspace
+	begin fdb.Key
+	end   fdb.Key
+	done  bool
+
+	// page holds the headers read from pageSub not yet handed out
+	page    []fdb.KeyValue
+	pageSub subspace.Subspace
+}
+
+func newObjectIter(s *FDBStore, types []plumbing.ObjectType) *objectIter {
+	iter := &objectIter{s: s, types: types}
+	iter.nextType()
+	return iter
+}
+
+// Moves the iterator on to the type index of the next type, if any.
+func (iter *objectIter) nextType() {
+	if len(iter.types) == 0 {
+		iter.done = true
+		return
+	}
+	iter.sub = iter.s.ss[objectOpKey].Sub(iter.types[0].String())
+	begin, end := iter.sub.FDBRangeKeys()
+	iter.begin, iter.end = begin.FDBKey(), end.FDBKey()
+	iter.types = iter.types[1:]
+}
+
+// Reads the next page of the type index into the iterator.
+func (iter *objectIter) fetch() error {
+	r := fdb.KeyRange{Begin: iter.begin, End: iter.end}
+	ret, err := iter.s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
+		ret, e = tr.GetRange(r, fdb.RangeOptions{Limit: objectIterBatch}).GetSliceWithError()
+		return
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to read object index page")
+	}
+	iter.page = ret.([]fdb.KeyValue)
+	iter.pageSub = iter.sub
+	if len(iter.page) < objectIterBatch {
+		iter.nextType()
+	} else {
+		iter.begin = fdb.Key(append(iter.page[len(iter.page)-1].Key, 0x00))
+	}
+	return nil
+}
+
+func (iter *objectIter) Next() (plumbing.EncodedObject, error) {
+	for {
+		for len(iter.page) == 0 {
+			if iter.done {
+				return nil, io.EOF
+			}
+			if err := iter.fetch(); err != nil {
+				return nil, err
+			}
+		}
+		kv := iter.page[0]
+		iter.page = iter.page[1:]
+
+		t, err := iter.pageSub.Unpack(kv.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode object index key")
+		}
+		// tuple[hash, "meta", "header"]
+		if len(t) != 3 || t[2] != "header" {
+			continue
+		}
+		return iter.decode(t[0].(string), kv.Value)
+	}
+}
+
+func (iter *objectIter) decode(hash string, value []byte) (plumbing.EncodedObject, error) {
+	header := new(ObjectHeader)
+	if err := json.Unmarshal(value, header); err != nil {
+		return nil, errors.Wrap(err, "failed to decode object header")
+	}
+	return newFDBObject(iter.s, plumbing.NewHash(hash), header), nil
+}
+
+func (iter *objectIter) ForEach(cb func(plumbing.EncodedObject) error) error {
+	return storer.ForEachIterator(iter, cb)
+}
+
+func (iter *objectIter) Close() {
+	iter.page = nil
+	iter.done = true
+}
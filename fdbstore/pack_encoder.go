@@ -0,0 +1,130 @@
+package fdbstore
+
+import (
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash"
+	"io"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/go-git/go-git/v5/utils/ioutil"
+	"github.com/pkg/errors"
+)
+
+// EncodePackfile writes a packfile with every object reachable from wants but
+// not from haves to w and returns the packfile checksum. Objects are selected
+// by walking commits and trees in FDB. Objects stored as deltas whose base is
+// part of the pack are sent as REF deltas as stored, everything else is
+// streamed from FDB part by part.
+func (s *FDBStore) EncodePackfile(w io.Writer, wants, haves []plumbing.Hash) (plumbing.Hash, error) {
+	hashes, err := revlist.Objects(s, wants, haves)
+	if err != nil {
+		return plumbing.ZeroHash, errors.Wrap(err, "failed to select pack objects")
+	}
+	headers, err := s.objectHeaders(hashes)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	e := &packEncoder{
+		s:       s,
+		sum:     sha1.New(),
+		headers: headers,
+		written: make(map[plumbing.Hash]bool, len(hashes)),
+	}
+	e.w = io.MultiWriter(w, e.sum)
+	e.zw = zlib.NewWriter(e.w)
+	if err := e.head(len(hashes)); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	for _, h := range hashes {
+		if err := e.encode(h); err != nil {
+			return plumbing.ZeroHash, errors.Wrapf(err, "failed to encode %s", h)
+		}
+	}
+	var checksum plumbing.Hash
+	copy(checksum[:], e.sum.Sum(nil))
+	if _, err := w.Write(checksum[:]); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	s.log.WithField("objects", len(hashes)).WithField("checksum", checksum).Info("encoded packfile")
+	return checksum, nil
+}
+
+type packEncoder struct {
+	s       *FDBStore
+	w       io.Writer
+	zw      *zlib.Writer
+	sum     hash.Hash
+	headers map[plumbing.Hash]*ObjectHeader
+	written map[plumbing.Hash]bool
+}
+
+func (e *packEncoder) head(count int) error {
+	buf := make([]byte, 0, 12)
+	buf = append(buf, 'P', 'A', 'C', 'K')
+	buf = binary.BigEndian.AppendUint32(buf, packfile.VersionSupported)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(count))
+	_, err := e.w.Write(buf)
+	return err
+}
+
+// Writes an object to the pack, delta bases go first so that every REF delta
+// refers back to an object earlier in the pack.
+func (e *packEncoder) encode(h plumbing.Hash) error {
+	if e.written[h] {
+		return nil
+	}
+	e.written[h] = true
+	header := e.headers[h]
+
+	if header.Delta != nil {
+		base := plumbing.NewHash(header.Delta.Base)
+		if _, ok := e.headers[base]; ok {
+			if err := e.encode(base); err != nil {
+				return err
+			}
+			return e.entry(plumbing.REFDeltaObject, header.Delta.Size, base[:], e.s.partsReader(h, header))
+		}
+	}
+
+	r, err := newFDBObject(e.s, h, header).Reader()
+	if err != nil {
+		return err
+	}
+	return e.entry(header.Type, header.Size, nil, r)
+}
+
+func (e *packEncoder) entry(t plumbing.ObjectType, size int64, ref []byte, r io.ReadCloser) (err error) {
+	defer ioutil.CheckClose(r, &err)
+	if err := writePackEntryHeader(e.w, t, size); err != nil {
+		return err
+	}
+	if _, err := e.w.Write(ref); err != nil {
+		return err
+	}
+	e.zw.Reset(e.w)
+	if _, err := io.Copy(e.zw, r); err != nil {
+		return err
+	}
+	return e.zw.Close()
+}
+
+// The entry header holds the type and a variable length size, the first byte
+// carries the type and the low four bits of the size.
+func writePackEntryHeader(w io.Writer, t plumbing.ObjectType, size int64) error {
+	b := byte(t)<<4 | byte(size&0x0f)
+	size >>= 4
+	var buf []byte
+	for size != 0 {
+		buf = append(buf, b|0x80)
+		b = byte(size & 0x7f)
+		size >>= 7
+	}
+	buf = append(buf, b)
+	_, err := w.Write(buf)
+	return err
+}
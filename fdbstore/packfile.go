@@ -0,0 +1,150 @@
+package fdbstore
+
+import (
+	"io"
+	"os"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/pkg/errors"
+)
+
+// Approximate number of bytes written per transaction when storing the
+// objects of a packfile, well below FDB's 10MB transaction limit.
+const packBatchSize = 4 << 20
+
+// PackfileWriter returns a writer go-git streams incoming packfiles into. The
+// packfile is spooled to a temporary file and parsed on Close, its objects are
+// written to FDB in large batched transactions instead of one transaction per
+// object.
+func (s *FDBStore) PackfileWriter() (io.WriteCloser, error) {
+	f, err := os.CreateTemp("", "fdbstore-pack-")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create packfile spool")
+	}
+	return &packWriter{s: s, f: f}, nil
+}
+
+type packWriter struct {
+	s *FDBStore
+	f *os.File
+	n int64
+}
+
+func (w *packWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *packWriter) Close() (err error) {
+	defer os.Remove(w.f.Name())
+	defer w.f.Close()
+	if w.n == 0 {
+		return nil
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	b := &packBatch{FDBStore: w.s, pending: make(map[plumbing.Hash]plumbing.EncodedObject)}
+	p, err := packfile.NewParserWithStorage(packfile.NewScanner(w.f), b)
+	if err != nil {
+		return err
+	}
+	h, err := p.Parse()
+	if err != nil {
+		return errors.Wrap(err, "failed to parse packfile")
+	}
+	if err := b.flush(); err != nil {
+		return err
+	}
+	w.s.log.WithField("pack", h).WithField("size", w.n).Info("stored packfile objects")
+	return nil
+}
+
+// packBatch collects the objects the packfile parser stores and writes them in
+// batches. Deltas are resolved by the parser against objects in the pack, the
+// pending batch or, for thin packs, objects already in the store.
+type packBatch struct {
+	*FDBStore
+	pending map[plumbing.Hash]plumbing.EncodedObject
+	objs    []*preparedObject
+	size    int
+}
+
+func (b *packBatch) SetEncodedObject(o plumbing.EncodedObject) (plumbing.Hash, error) {
+	h := o.Hash()
+	if b.chunking && o.Size() >= chunkedObjectMinSize {
+		_, err := storeChunkedObject(b.FDBStore, o)
+		return h, err
+	}
+	if o.Size() > maxInlineObjectSize {
+		return h, storeStagedObject(b.FDBStore, o)
+	}
+	p, err := prepareObject(b.FDBStore, o)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	b.objs = append(b.objs, p)
+	b.pending[h] = o
+	b.size += p.size()
+	if b.size >= packBatchSize {
+		if err := b.flush(); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+	return h, nil
+}
+
+// Writes the pending batch, skipping objects that are already stored.
+func (b *packBatch) flush() error {
+	if len(b.objs) == 0 {
+		return nil
+	}
+	_, err := b.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+		headers := make([]fdb.FutureByteSlice, len(b.objs))
+		for i, p := range b.objs {
+			headers[i] = tr.Get(b.genObjectMetaKey(p.h, "header"))
+		}
+		for i, p := range b.objs {
+			if isNilKey(headers[i].MustGet()) {
+				b.writePreparedObject(tr, p)
+			}
+		}
+		return
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to write packfile object batch")
+	}
+	b.log.WithField("objects", len(b.objs)).WithField("size", b.size).Debug("wrote packfile object batch")
+	b.objs = nil
+	b.pending = make(map[plumbing.Hash]plumbing.EncodedObject)
+	b.size = 0
+	return nil
+}
+
+func (b *packBatch) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	if o, ok := b.pending[h]; ok {
+		if t != plumbing.AnyObject && o.Type() != t {
+			return nil, plumbing.ErrObjectNotFound
+		}
+		return o, nil
+	}
+	return b.FDBStore.EncodedObject(t, h)
+}
+
+func (b *packBatch) HasEncodedObject(h plumbing.Hash) error {
+	if _, ok := b.pending[h]; ok {
+		return nil
+	}
+	return b.FDBStore.HasEncodedObject(h)
+}
+
+func (b *packBatch) EncodedObjectSize(h plumbing.Hash) (int64, error) {
+	if o, ok := b.pending[h]; ok {
+		return o.Size(), nil
+	}
+	return b.FDBStore.EncodedObjectSize(h)
+}
@@ -0,0 +1,330 @@
+package fdbstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+)
+
+// ProtectionRule restricts changes to the references matching Pattern, a
+// path.Match pattern such as refs/heads/main or refs/tags/v*. Rules apply to
+// references in every namespace.
+type ProtectionRule struct {
+	Pattern string
+	// DenyDelete rejects removing matching references.
+	DenyDelete bool `json:",omitempty"`
+	// DenyNonFastForward rejects updates whose new commit doesn't descend
+	// from the old one.
+	DenyNonFastForward bool `json:",omitempty"`
+	// RequireLinearHistory rejects updates that bring in merge commits.
+	RequireLinearHistory bool `json:",omitempty"`
+}
+
+func (r *ProtectionRule) matches(n plumbing.ReferenceName) bool {
+	ok, _ := path.Match(r.Pattern, n.String())
+	return ok
+}
+
+var ErrProtectedRef = fmt.Errorf("reference is protected")
+
+// ProtectedRefError is returned when a reference change violates a protection
+// rule, it matches ErrProtectedRef with errors.Is.
+type ProtectedRefError struct {
+	Ref     plumbing.ReferenceName
+	Pattern string
+	Reason  string
+}
+
+func (e *ProtectedRefError) Error() string {
+	return fmt.Sprintf("%s: %s (rule %s): %s", ErrProtectedRef, e.Ref, e.Pattern, e.Reason)
+}
+
+func (e *ProtectedRefError) Is(target error) bool {
+	return target == ErrProtectedRef
+}
+
+// ProtectionRules returns the protection rules of the repository.
+func (s *FDBStore) ProtectionRules() ([]ProtectionRule, error) {
+	ret, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
+		return s.protectionRules(tr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret.([]ProtectionRule), nil
+}
+
+// SetProtectionRules replaces the protection rules of the repository, they
+// are enforced by every reference change made after.
+func (s *FDBStore) SetProtectionRules(rules []ProtectionRule) error {
+	for _, r := range rules {
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return errors.Wrapf(err, "invalid protection pattern %q", r.Pattern)
+		}
+	}
+	payload, err := json.Marshal(rules)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode protection rules")
+	}
+	_, err = s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+		if len(rules) == 0 {
+			tr.Clear(s.genProtectionKey())
+		} else {
+			tr.Set(s.genProtectionKey(), payload)
+		}
+		return
+	})
+	return err
+}
+
+func (s *FDBStore) protectionRules(tr fdb.ReadTransaction) ([]ProtectionRule, error) {
+	rules := make([]ProtectionRule, 0)
+	v := tr.Get(s.genProtectionKey()).MustGet()
+	if len(v) == 0 {
+		return rules, nil
+	}
+	if err := json.Unmarshal(v, &rules); err != nil {
+		return nil, errors.Wrap(err, "failed to decode protection rules")
+	}
+	return rules, nil
+}
+
+// Number of times UpdateReferences checks the history of its updates again
+// when references or rules change while it's committing.
+const protectionRetries = 3
+
+var errProtectionStale = fmt.Errorf("references changed since their history was checked")
+
+// protectionChecks holds the outcome of the history rules for the updates of
+// a reference transaction. Walking history takes a transaction per commit, so
+// it's done before the reference transaction, for the values references had
+// then. The reference transaction only confirms those are still current.
+type protectionChecks struct {
+	rules []ProtectionRule
+	refs  map[plumbing.ReferenceName]*historyCheck
+}
+
+// historyCheck is the outcome of the history rules for a reference moving
+// from old to new, err is nil if the move is allowed.
+type historyCheck struct {
+	old, new plumbing.Hash
+	err      error
+}
+
+// Checks the history rules for updates against the current references,
+// outside of any reference transaction.
+func (s *FDBStore) prepareProtection(updates []ReferenceUpdate) (*protectionChecks, error) {
+	type current struct {
+		rules []ProtectionRule
+		olds  map[plumbing.ReferenceName]*plumbing.Reference
+	}
+	ret, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
+		rules, err := s.protectionRules(tr)
+		if err != nil {
+			return nil, err
+		}
+		c := current{rules: rules, olds: make(map[plumbing.ReferenceName]*plumbing.Reference)}
+		if !hasHistoryRules(rules) {
+			return c, nil
+		}
+		for _, u := range updates {
+			if u.Op == RefDelete {
+				continue
+			}
+			n := s.nsRefName(u.Name)
+			old, _, err := s.storedReference(tr, n)
+			if err != nil && err != plumbing.ErrReferenceNotFound {
+				return nil, errors.Wrap(err, "failed to read previous ref")
+			}
+			c.olds[n] = old
+		}
+		return c, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := ret.(current)
+	checks := &protectionChecks{rules: c.rules, refs: make(map[plumbing.ReferenceName]*historyCheck)}
+	for _, u := range updates {
+		if u.Op == RefDelete {
+			continue
+		}
+		n := s.nsRefName(u.Name)
+		old := c.olds[n]
+		if !needsHistoryCheck(old, u.New) {
+			continue
+		}
+		checks.refs[n] = &historyCheck{
+			old: old.Hash(),
+			new: u.New.Hash(),
+			err: s.checkHistory(c.rules, n, old.Hash(), u.New.Hash()),
+		}
+	}
+	return checks, nil
+}
+
+// Checks the change of the reference with full name n from old to new against
+// the protection rules within an existing transaction. A nil old is a create
+// and a nil new a delete. History rules take their outcome from checks, if it
+// was computed for other values or rules errProtectionStale is returned.
+func (s *FDBStore) checkProtection(tr fdb.Transaction, n plumbing.ReferenceName, old, new *plumbing.Reference, checks *protectionChecks) error {
+	if old == nil {
+		// nothing to protect yet
+		return nil
+	}
+	rules, err := s.protectionRules(tr)
+	if err != nil {
+		return err
+	}
+	name := plumbing.ReferenceName(stripAllNamespaces(n.String()))
+	history := false
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.matches(name) {
+			continue
+		}
+		if new == nil {
+			if rule.DenyDelete {
+				return &ProtectedRefError{Ref: n, Pattern: rule.Pattern, Reason: "deletion denied"}
+			}
+			continue
+		}
+		history = history || rule.DenyNonFastForward || rule.RequireLinearHistory
+	}
+	if !history || !needsHistoryCheck(old, new) {
+		return nil
+	}
+	if checks == nil || !reflect.DeepEqual(checks.rules, rules) {
+		return errProtectionStale
+	}
+	c := checks.refs[n]
+	if c == nil || c.old != old.Hash() || c.new != new.Hash() {
+		return errProtectionStale
+	}
+	return c.err
+}
+
+// Checks the history rules matching the reference with full name n for a move
+// from old to new.
+func (s *FDBStore) checkHistory(rules []ProtectionRule, n plumbing.ReferenceName, old, new plumbing.Hash) error {
+	name := plumbing.ReferenceName(stripAllNamespaces(n.String()))
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.matches(name) {
+			continue
+		}
+		if rule.DenyNonFastForward {
+			ff, err := s.isFastForward(old, new)
+			if err == plumbing.ErrObjectNotFound {
+				return &ProtectedRefError{Ref: n, Pattern: rule.Pattern, Reason: "commit not found, can't check for fast-forward"}
+			}
+			if err != nil {
+				return err
+			}
+			if !ff {
+				return &ProtectedRefError{Ref: n, Pattern: rule.Pattern, Reason: "non fast-forward update denied"}
+			}
+		}
+		if rule.RequireLinearHistory {
+			linear, err := s.isLinearHistory(old, new)
+			if err == plumbing.ErrObjectNotFound {
+				return &ProtectedRefError{Ref: n, Pattern: rule.Pattern, Reason: "new commit not found, can't check for merge commits"}
+			}
+			if err != nil {
+				return err
+			}
+			if !linear {
+				return &ProtectedRefError{Ref: n, Pattern: rule.Pattern, Reason: "merge commits denied"}
+			}
+		}
+	}
+	return nil
+}
+
+func hasHistoryRules(rules []ProtectionRule) bool {
+	for _, r := range rules {
+		if r.DenyNonFastForward || r.RequireLinearHistory {
+			return true
+		}
+	}
+	return false
+}
+
+// Only moves of a hash reference to another hash are subject to history rules.
+func needsHistoryCheck(old, new *plumbing.Reference) bool {
+	return old != nil && new != nil &&
+		old.Type() == plumbing.HashReference && new.Type() == plumbing.HashReference &&
+		old.Hash() != new.Hash()
+}
+
+// Whether the commit new descends from old, plumbing.ErrObjectNotFound if
+// either is missing. References to anything but commits, such as annotated
+// tags, can't fast-forward.
+func (s *FDBStore) isFastForward(old, new plumbing.Hash) (bool, error) {
+	oc, err := object.GetCommit(s, old)
+	if err == plumbing.ErrObjectNotFound {
+		return false, err
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read old commit")
+	}
+	nc, err := object.GetCommit(s, new)
+	if err == plumbing.ErrObjectNotFound {
+		return false, err
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read new commit")
+	}
+	return oc.IsAncestor(nc)
+}
+
+// Whether none of the commits reachable from new but not through old are
+// merges, plumbing.ErrObjectNotFound if new is missing.
+func (s *FDBStore) isLinearHistory(old, new plumbing.Hash) (bool, error) {
+	nc, err := object.GetCommit(s, new)
+	if err == plumbing.ErrObjectNotFound {
+		return false, err
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read new commit")
+	}
+	iter := object.NewCommitPreorderIter(nc, nil, []plumbing.Hash{old})
+	defer iter.Close()
+	for {
+		c, err := iter.Next()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, errors.Wrap(err, "failed to walk new commits")
+		}
+		if c.NumParents() > 1 {
+			return false, nil
+		}
+	}
+}
+
+// Returns the name a reference has within its innermost namespace.
+func stripAllNamespaces(n string) string {
+	for strings.HasPrefix(n, namespaceRefPrefix) {
+		i := strings.Index(n[len(namespaceRefPrefix):], "/")
+		if i < 0 {
+			break
+		}
+		n = n[len(namespaceRefPrefix)+i+1:]
+	}
+	return n
+}
+
+// key = dir[url]/tuple[protection]
+func (s *FDBStore) genProtectionKey() fdb.Key {
+	return s.genStorageKey(protectionOpKey)
+}
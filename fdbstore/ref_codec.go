@@ -0,0 +1,136 @@
+package fdbstore
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+)
+
+// References are stored as a tag byte followed by the target, the name is
+// already in the key. Hash references hold the 20 raw hash bytes and symbolic
+// references the name of their target.
+const (
+	refTagHash     byte = 0x01
+	refTagSymbolic byte = 0x02
+	// Values written before the binary encoding are JSON encoded SlowRefs,
+	// which always start with this byte.
+	refTagJSON byte = '{'
+	// Set on the tag of packed references, see PackRefs.
+	refPackedFlag byte = 0x80
+)
+
+// Number of references rewritten per transaction by MigrateReferences.
+const refMigrateBatch = 500
+
+var ErrInvalidRefValue = fmt.Errorf("invalid reference value")
+
+// SlowRef is the JSON encoding references used to be stored in, it's still
+// read but no longer written.
+type SlowRef struct {
+	Name   string
+	Target string
+}
+
+func encodeReference(r *plumbing.Reference) ([]byte, error) {
+	switch r.Type() {
+	case plumbing.HashReference:
+		h := r.Hash()
+		return append([]byte{refTagHash}, h[:]...), nil
+	case plumbing.SymbolicReference:
+		return append([]byte{refTagSymbolic}, r.Target()...), nil
+	}
+	return nil, fmt.Errorf("%w: can't encode %s", ErrInvalidRefValue, r)
+}
+
+// Decodes the stored value of the reference named n, in the binary or the
+// legacy JSON encoding.
+func (s *FDBStore) decodeReference(n plumbing.ReferenceName, value []byte) (*plumbing.Reference, error) {
+	if len(value) == 0 {
+		return nil, ErrInvalidRefValue
+	}
+	switch value[0] &^ refPackedFlag {
+	case refTagHash:
+		if len(value) != 1+len(plumbing.ZeroHash) {
+			return nil, fmt.Errorf("%w: bad hash length for %s", ErrInvalidRefValue, n)
+		}
+		var h plumbing.Hash
+		copy(h[:], value[1:])
+		return plumbing.NewHashReference(n, h), nil
+	case refTagSymbolic:
+		return plumbing.NewSymbolicReference(n, plumbing.ReferenceName(value[1:])), nil
+	case refTagJSON:
+		r := new(SlowRef)
+		if err := json.Unmarshal(value, r); err != nil {
+			s.log.WithError(err).Error("failed to unmarshal ref")
+			return nil, err
+		}
+		return plumbing.NewReferenceFromStrings(r.Name, r.Target), nil
+	}
+	return nil, fmt.Errorf("%w: unknown tag %#x for %s", ErrInvalidRefValue, value[0], n)
+}
+
+// Loose references are those changed since they were last packed, values in
+// the JSON encoding were all written before packing existed.
+func isLooseRefValue(value []byte) bool {
+	return len(value) > 0 && value[0]&refPackedFlag == 0
+}
+
+// Marks an encoded reference as packed.
+func packRefValue(value []byte) []byte {
+	value[0] |= refPackedFlag
+	return value
+}
+
+// MigrateReferences rewrites references still stored as JSON in the binary
+// encoding and returns how many it rewrote. Both encodings are read, so
+// migrating is optional and safe to run while the store is in use, a ref
+// changed in the meantime conflicts and is retried.
+func (s *FDBStore) MigrateReferences() (int, error) {
+	kr, err := stringPrefixRange(s.ss[refOpKey], "")
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to configure ref range")
+	}
+	migrated := 0
+	for {
+		var kvs []fdb.KeyValue
+		var n int
+		_, err := s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+			kvs, n = nil, 0
+			page, err := tr.GetRange(kr, fdb.RangeOptions{Limit: refMigrateBatch}).GetSliceWithError()
+			if err != nil {
+				return nil, err
+			}
+			for _, kv := range page {
+				if len(kv.Value) == 0 || kv.Value[0] != refTagJSON {
+					continue
+				}
+				r, err := s.decodeReference("", kv.Value)
+				if err != nil {
+					return nil, err
+				}
+				payload, err := encodeReference(r)
+				if err != nil {
+					return nil, err
+				}
+				// JSON refs are all loose, so they stay loose
+				tr.Set(kv.Key, payload)
+				n++
+			}
+			kvs = page
+			return
+		})
+		if err != nil {
+			return migrated, errors.Wrap(err, "failed to migrate refs")
+		}
+		migrated += n
+		if len(kvs) < refMigrateBatch {
+			break
+		}
+		kr.Begin = append(append(fdb.Key{}, kvs[len(kvs)-1].Key...), 0x00)
+	}
+	s.log.WithField("migrated", migrated).Info("migrated refs to binary encoding")
+	return migrated, nil
+}
@@ -0,0 +1,101 @@
+package fdbstore
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/sirupsen/logrus"
+)
+
+func testStore() *FDBStore {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return &FDBStore{log: log}
+}
+
+func TestReferenceCodecRoundTrip(t *testing.T) {
+	s := testStore()
+	tests := []*plumbing.Reference{
+		plumbing.NewHashReference("refs/heads/main", plumbing.NewHash("6ecf0ef2c2dffb796033e5a02219af86ec6584e5")),
+		plumbing.NewHashReference("refs/tags/v1", plumbing.ZeroHash),
+		plumbing.NewSymbolicReference(plumbing.HEAD, "refs/heads/main"),
+	}
+	for _, r := range tests {
+		v, err := encodeReference(r)
+		if err != nil {
+			t.Fatalf("encodeReference(%s): %v", r, err)
+		}
+		if !isLooseRefValue(v) {
+			t.Errorf("%s: fresh value isn't loose", r)
+		}
+		got, err := s.decodeReference(r.Name(), v)
+		if err != nil {
+			t.Fatalf("decodeReference(%s): %v", r, err)
+		}
+		if got.String() != r.String() {
+			t.Errorf("round trip of %s = %s", r, got)
+		}
+
+		p := packRefValue(append([]byte(nil), v...))
+		packed, err := s.decodeReference(r.Name(), p)
+		if err != nil {
+			t.Fatalf("decodeReference(packed %s): %v", r, err)
+		}
+		if isLooseRefValue(p) {
+			t.Errorf("%s: packed value is loose", r)
+		}
+		if packed.String() != r.String() {
+			t.Errorf("packed %s decoded to %s", r, packed)
+		}
+	}
+}
+
+func TestDecodeLegacyReference(t *testing.T) {
+	s := testStore()
+	tests := []struct {
+		value string
+		want  *plumbing.Reference
+	}{
+		{
+			`{"Name":"refs/heads/main","Target":"6ecf0ef2c2dffb796033e5a02219af86ec6584e5"}`,
+			plumbing.NewHashReference("refs/heads/main", plumbing.NewHash("6ecf0ef2c2dffb796033e5a02219af86ec6584e5")),
+		},
+		{
+			`{"Name":"HEAD","Target":"ref: refs/heads/main"}`,
+			plumbing.NewSymbolicReference(plumbing.HEAD, "refs/heads/main"),
+		},
+	}
+	for _, tt := range tests {
+		v := []byte(tt.value)
+		if !isLooseRefValue(v) {
+			t.Errorf("%s: JSON value isn't loose", tt.value)
+		}
+		got, err := s.decodeReference(tt.want.Name(), v)
+		if err != nil {
+			t.Fatalf("decodeReference(%s): %v", tt.value, err)
+		}
+		if got.String() != tt.want.String() {
+			t.Errorf("decodeReference(%s) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeInvalidReference(t *testing.T) {
+	s := testStore()
+	tests := map[string][]byte{
+		"empty":            nil,
+		"short hash":       append([]byte{refTagHash}, make([]byte, 19)...),
+		"long hash":        append([]byte{refTagHash}, make([]byte, 21)...),
+		"short packed":     append([]byte{refTagHash | refPackedFlag}, make([]byte, 4)...),
+		"unknown tag":      {0x7f, 'x'},
+		"packed bad tag":   {0x7f | refPackedFlag},
+		"hash without sum": {refTagHash},
+	}
+	for name, v := range tests {
+		if _, err := s.decodeReference("refs/heads/main", v); !errors.Is(err, ErrInvalidRefValue) {
+			t.Errorf("%s: err = %v, want ErrInvalidRefValue", name, err)
+		}
+	}
+}
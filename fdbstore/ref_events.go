@@ -0,0 +1,233 @@
+package fdbstore
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+)
+
+const (
+	// How long reference change events are kept for subscribers, a subscriber
+	// falling further behind misses events.
+	refEventRetention = 10 * time.Minute
+	// Number of events read per transaction by a subscription.
+	refEventBatch = 500
+	// FDB commit versions advance by about this many versions per second.
+	fdbVersionsPerSecond = 1000000
+)
+
+// RefEvent describes a reference change. Old is nil for a newly created
+// reference and New is nil for a removed one.
+type RefEvent struct {
+	Name    plumbing.ReferenceName
+	Old     *plumbing.Reference
+	New     *plumbing.Reference
+	Version tuple.Versionstamp
+}
+
+// refEvent is how a RefEvent is stored, references are stored by their name
+// and target.
+type refEvent struct {
+	Name string
+	Old  string `json:",omitempty"`
+	New  string `json:",omitempty"`
+}
+
+// Records a reference change for subscribers within an existing transaction
+// and bumps the change counter subscriptions watch. seq is the position of the
+// change within the transaction, it's the user version of the event's
+// versionstamp so every change of a batch gets a key of its own. Events past
+// their retention are trimmed on the way.
+func (s *FDBStore) recordRefEvent(tr fdb.Transaction, seq uint16, n plumbing.ReferenceName, old, new *plumbing.Reference) error {
+	e := refEvent{Name: n.String()}
+	if old != nil {
+		e.Old = old.Strings()[1]
+	}
+	if new != nil {
+		e.New = new.Strings()[1]
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode ref event")
+	}
+	key, err := s.ss[refEventOpKey].PackWithVersionstamp(tuple.Tuple{tuple.IncompleteVersionstamp(seq)})
+	if err != nil {
+		return errors.Wrap(err, "failed to pack ref event key")
+	}
+	tr.SetVersionstampedKey(key, payload)
+	if err := incrKey(tr, s.genRefVersionKey()); err != nil {
+		return errors.Wrap(err, "failed to bump ref version")
+	}
+
+	rv := tr.GetReadVersion().MustGet()
+	if cutoff := rv - int64(refEventRetention/time.Second)*fdbVersionsPerSecond; cutoff > 0 {
+		tr.ClearRange(fdb.KeyRange{
+			Begin: s.ss[refEventOpKey].FDBKey(),
+			End:   s.ss[refEventOpKey].Pack(tuple.Tuple{versionstampAt(cutoff)}),
+		})
+	}
+	return nil
+}
+
+// Returns the first versionstamp of commit version v.
+func versionstampAt(v int64) tuple.Versionstamp {
+	var vs tuple.Versionstamp
+	binary.BigEndian.PutUint64(vs.TransactionVersion[:8], uint64(v))
+	return vs
+}
+
+// RefSubscription delivers reference change events on C until its context is
+// canceled or an error occurs, C is closed either way and Err reports the
+// error if there was one.
+type RefSubscription struct {
+	C <-chan RefEvent
+
+	mu  sync.Mutex
+	err error
+}
+
+func (sub *RefSubscription) Err() error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	return sub.err
+}
+
+// SubscribeReferences subscribes to changes of references of the selected
+// namespace whose name starts with prefix, an empty prefix matches every
+// reference. Only changes committed
+// after the subscription is made are delivered, in commit order. Events are
+// picked up through an FDB watch on the reference change counter, so an idle
+// subscription doesn't poll.
+func (s *FDBStore) SubscribeReferences(ctx context.Context, prefix string) (*RefSubscription, error) {
+	pr, err := fdb.PrefixRange(s.ss[refEventOpKey].FDBKey())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to configure ref event range")
+	}
+	// start after the last event committed so far
+	ret, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
+		ret, e = tr.GetRange(pr, fdb.RangeOptions{Limit: 1, Reverse: true}).GetSliceWithError()
+		return
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read last ref event")
+	}
+	kr := fdb.KeyRange{Begin: pr.Begin, End: pr.End}
+	if kvs := ret.([]fdb.KeyValue); len(kvs) > 0 {
+		kr.Begin = append(append(fdb.Key{}, kvs[0].Key...), 0x00)
+	}
+
+	c := make(chan RefEvent)
+	sub := &RefSubscription{C: c}
+	go func() {
+		defer close(c)
+		err := s.watchRefEvents(ctx, kr, s.refPrefix+prefix, c)
+		if err != nil && ctx.Err() == nil {
+			s.log.WithError(err).Error("ref subscription failed")
+			sub.mu.Lock()
+			sub.err = err
+			sub.mu.Unlock()
+		}
+	}()
+	return sub, nil
+}
+
+// Delivers events in kr matching prefix on c, whenever all events are
+// consumed it waits on the change counter for new ones.
+func (s *FDBStore) watchRefEvents(ctx context.Context, kr fdb.KeyRange, prefix string, c chan<- RefEvent) error {
+	for {
+		ret, err := s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+			kvs, err := tr.GetRange(kr, fdb.RangeOptions{Limit: refEventBatch}).GetSliceWithError()
+			if err != nil {
+				return nil, err
+			}
+			if len(kvs) > 0 {
+				return kvs, nil
+			}
+			// nothing new, the watch fires once a later change commits
+			return tr.Watch(s.genRefVersionKey()), nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to read ref events")
+		}
+
+		if w, ok := ret.(fdb.FutureNil); ok {
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-ctx.Done():
+					w.Cancel()
+				case <-done:
+				}
+			}()
+			err := w.Get()
+			close(done)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				return errors.Wrap(err, "ref watch failed")
+			}
+			continue
+		}
+
+		kvs := ret.([]fdb.KeyValue)
+		for _, kv := range kvs {
+			e, err := s.decodeRefEvent(kv)
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(e.Name.String(), prefix) {
+				continue
+			}
+			e.Name = s.stripNamespaceName(e.Name)
+			if e.Old != nil {
+				e.Old = s.stripNamespace(e.Old)
+			}
+			if e.New != nil {
+				e.New = s.stripNamespace(e.New)
+			}
+			select {
+			case c <- *e:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		kr.Begin = append(append(fdb.Key{}, kvs[len(kvs)-1].Key...), 0x00)
+	}
+}
+
+func (s *FDBStore) decodeRefEvent(kv fdb.KeyValue) (*RefEvent, error) {
+	t, err := s.ss[refEventOpKey].Unpack(kv.Key)
+	if err != nil || len(t) != 1 {
+		return nil, errors.Errorf("invalid ref event key %s", kv.Key)
+	}
+	v, ok := t[0].(tuple.Versionstamp)
+	if !ok {
+		return nil, errors.Errorf("invalid ref event key %s", kv.Key)
+	}
+	stored := new(refEvent)
+	if err := json.Unmarshal(kv.Value, stored); err != nil {
+		return nil, errors.Wrap(err, "failed to decode ref event")
+	}
+	e := &RefEvent{Name: plumbing.ReferenceName(stored.Name), Version: v}
+	if stored.Old != "" {
+		e.Old = plumbing.NewReferenceFromStrings(stored.Name, stored.Old)
+	}
+	if stored.New != "" {
+		e.New = plumbing.NewReferenceFromStrings(stored.Name, stored.New)
+	}
+	return e, nil
+}
+
+// key = dir[url]/tuple[refs-version]
+func (s *FDBStore) genRefVersionKey() fdb.Key {
+	return s.d.Pack(tuple.Tuple{"refs-version"})
+}
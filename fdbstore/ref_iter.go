@@ -0,0 +1,106 @@
+package fdbstore
+
+import (
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/pkg/errors"
+)
+
+// Number of references fetched per transaction while iterating.
+const refIterBatch = 1000
+
+// refIter walks one or more key ranges of the ref subspace, reading a page of
+// references per transaction.
+type refIter struct {
+	s      *FDBStore
+	ranges []fdb.KeyRange
+	page   []fdb.KeyValue
+}
+
+// Reads the next page of the current range into the iterator.
+func (iter *refIter) fetch() error {
+	r := iter.ranges[0]
+	ret, err := iter.s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
+		ret, e = tr.GetRange(r, fdb.RangeOptions{Limit: refIterBatch}).GetSliceWithError()
+		return
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to read refs page")
+	}
+	iter.page = ret.([]fdb.KeyValue)
+	if len(iter.page) < refIterBatch {
+		iter.ranges = iter.ranges[1:]
+	} else {
+		iter.ranges[0].Begin = append(append(fdb.Key{}, iter.page[len(iter.page)-1].Key...), 0x00)
+	}
+	return nil
+}
+
+func (iter *refIter) Next() (*plumbing.Reference, error) {
+	for len(iter.page) == 0 {
+		if len(iter.ranges) == 0 {
+			return nil, io.EOF
+		}
+		if err := iter.fetch(); err != nil {
+			return nil, err
+		}
+	}
+	kv := iter.page[0]
+	iter.page = iter.page[1:]
+	name, err := iter.s.refKeyName(kv.Key)
+	if err != nil {
+		return nil, err
+	}
+	r, err := iter.s.decodeReference(name, kv.Value)
+	if err != nil {
+		return nil, err
+	}
+	return iter.s.stripNamespace(r), nil
+}
+
+func (iter *refIter) ForEach(cb func(*plumbing.Reference) error) error {
+	defer iter.Close()
+	for {
+		r, err := iter.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := cb(r); err != nil {
+			if err == storer.ErrStop {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (iter *refIter) Close() {
+	iter.page = nil
+	iter.ranges = nil
+}
+
+// Sorts prefixes and drops those covered by a shorter one, so that walking
+// them in turn yields every reference once and in name order. No prefixes
+// means all references.
+func dedupePrefixes(prefixes []string) []string {
+	if len(prefixes) == 0 {
+		return []string{""}
+	}
+	sorted := append([]string{}, prefixes...)
+	sort.Strings(sorted)
+	out := sorted[:1]
+	for _, p := range sorted[1:] {
+		if !strings.HasPrefix(p, out[len(out)-1]) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -1,9 +1,11 @@
 package fdbstore
 
 import (
-	"encoding/json"
+	"fmt"
+	"strings"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
 	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/storer"
@@ -11,133 +13,290 @@ import (
 	"github.com/pkg/errors"
 )
 
-type SlowRef struct {
-	Name   string
-	Target string
-}
+// Maximum number of symbolic references followed when resolving, git's own
+// limit.
+const maxSymrefDepth = 5
+
+var (
+	ErrSymrefCycle   = fmt.Errorf("symbolic reference cycle")
+	ErrSymrefTooDeep = fmt.Errorf("symbolic reference chain too deep")
+)
 
 func (s *FDBStore) Reference(n plumbing.ReferenceName) (*plumbing.Reference, error) {
 	ret, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
-		ret = tr.Get(s.genRefKey(n)).MustGet()
-		return
+		return s.reference(tr, n)
 	})
 	if err != nil {
 		return nil, err
 	}
+	return ret.(*plumbing.Reference), nil
+}
 
-	if ret == nil {
-		s.log.Debug("ret is nil")
-		return nil, plumbing.ErrReferenceNotFound
+// Reads a reference of the selected namespace within an existing transaction.
+func (s *FDBStore) reference(tr fdb.ReadTransaction, n plumbing.ReferenceName) (*plumbing.Reference, error) {
+	r, err := s.rawReference(tr, s.nsRefName(n))
+	if err != nil {
+		return nil, err
 	}
+	return s.stripNamespace(r), nil
+}
 
-	ref := ret.([]byte)
+// Reads a reference by its full name, regardless of the selected namespace.
+func (s *FDBStore) rawReference(tr fdb.ReadTransaction, n plumbing.ReferenceName) (*plumbing.Reference, error) {
+	r, _, err := s.storedReference(tr, n)
+	return r, err
+}
+
+// Like rawReference, but also reports whether the reference is loose.
+func (s *FDBStore) storedReference(tr fdb.ReadTransaction, n plumbing.ReferenceName) (*plumbing.Reference, bool, error) {
+	ref := tr.Get(s.genRefKey(n)).MustGet()
 	if len(ref) == 0 {
-		s.log.WithField("ref_name", n).Debug("ref is 0")
-		return nil, plumbing.ErrReferenceNotFound
+		s.log.WithField("ref_name", n).Debug("ref not found")
+		return nil, false, plumbing.ErrReferenceNotFound
+	}
+	r, err := s.decodeReference(n, ref)
+	if err != nil {
+		return nil, false, err
 	}
-	s.log.Debugf("ref: %s", ref)
+	s.log.Debugf("ref: %s", r)
+	return r, isLooseRefValue(ref), nil
+}
 
-	r := new(SlowRef)
-	if err = json.Unmarshal(ref, r); err != nil {
-		s.log.WithError(err).Error("failed to unmarshal ref")
+// ResolveReference follows the chain of symbolic references starting at n and
+// returns the hash reference it ends in, reading the whole chain in a single
+// transaction. Chains longer than maxSymrefDepth fail with ErrSymrefTooDeep
+// and chains that loop with ErrSymrefCycle.
+func (s *FDBStore) ResolveReference(n plumbing.ReferenceName) (*plumbing.Reference, error) {
+	ret, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
+		return s.resolveReference(tr, n)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret.(*plumbing.Reference), nil
+}
+
+func (s *FDBStore) resolveReference(tr fdb.ReadTransaction, n plumbing.ReferenceName) (*plumbing.Reference, error) {
+	seen := make(map[plumbing.ReferenceName]bool, maxSymrefDepth)
+	for depth := 0; ; depth++ {
+		if seen[n] {
+			return nil, fmt.Errorf("%w: %s", ErrSymrefCycle, n)
+		}
+		if depth > maxSymrefDepth {
+			return nil, fmt.Errorf("%w: %s", ErrSymrefTooDeep, n)
+		}
+		seen[n] = true
+		r, err := s.reference(tr, n)
+		if err != nil {
+			return nil, err
+		}
+		if r.Type() != plumbing.SymbolicReference {
+			return r, nil
+		}
+		n = r.Target()
 	}
-	return plumbing.NewReferenceFromStrings(r.Name, r.Target), err
 }
 
 func (s *FDBStore) SetReference(r *plumbing.Reference) error {
-	raw := r.Strings()
-	payload, err := json.Marshal(SlowRef{
-		Name:   raw[0],
-		Target: raw[1],
-	})
+	return s.UpdateReferences([]ReferenceUpdate{{Op: RefUpdate, Name: r.Name(), New: r}})
+}
+
+// Writes a reference of the selected namespace within an existing transaction
+// and logs the change to its reflog. The reference is loose until packed again.
+// seq is the position of the change within the transaction.
+func (s *FDBStore) setReference(tr fdb.Transaction, seq uint16, r *plumbing.Reference, l refLogInfo) error {
+	r = s.nsRef(r)
+	old, loose, err := s.storedReference(tr, r.Name())
+	if err != nil && err != plumbing.ErrReferenceNotFound {
+		return errors.Wrap(err, "failed to read previous ref")
+	}
+	payload, err := encodeReference(r)
 	if err != nil {
 		return errors.Wrap(err, "failed to encode ref")
 	}
-	_, err = s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
-		tr.Set(fdb.Key(s.genRefKey(r.Name())), payload)
-		ierr := incrKey(tr, s.genRefCounterKey()) //TODO: fix hackity hack
-		if ierr != nil {
-			s.log.WithError(ierr).Error("failed to incr global refs counter")
-		}
-		return
-	})
-	return err
+	tr.Set(fdb.Key(s.genRefKey(r.Name())), payload)
+	if err := s.appendReflog(tr, r.Name(), refHash(old), r.Hash(), l); err != nil {
+		return err
+	}
+	if err := s.recordRefEvent(tr, seq, r.Name(), old, r); err != nil {
+		return err
+	}
+	if !loose {
+		s.addLooseRefs(tr, r.Name(), 1)
+	}
+	return nil
 }
 
+// CheckAndSetReference sets r if the reference currently matches old, the
+// compare and the set happen in one transaction so concurrent updates of the
+// same reference conflict instead of overwriting each other. As with go-git's
+// other storers a nil old sets r unconditionally, go-git relies on that to
+// overwrite HEAD, branches and tags. Use CreateReference to require that the
+// reference doesn't exist yet.
 func (s *FDBStore) CheckAndSetReference(r, old *plumbing.Reference) error {
-	//TODO: actually do a in a proper transact/cas op
-	// just reusing the existing calls because im just fucking around
 	if r == nil {
 		return nil
 	}
+	return s.UpdateReferences([]ReferenceUpdate{{Op: RefUpdate, Name: r.Name(), Old: old, New: r}})
+}
 
-	if old != nil {
-		tmp, err := s.Reference(r.Name())
-		if err != nil {
-			return errors.Wrap(err, "failed fetching ref for cas")
-		}
-		if tmp != nil && tmp.Hash() != old.Hash() {
-			return storage.ErrReferenceHasChanged
+// CreateReference sets r only if no reference with its name exists, failing
+// with storage.ErrReferenceHasChanged otherwise.
+func (s *FDBStore) CreateReference(r *plumbing.Reference) error {
+	return s.UpdateReferences([]ReferenceUpdate{{Op: RefCreate, Name: r.Name(), New: r}})
+}
+
+// Fails with storage.ErrReferenceHasChanged unless the reference n currently
+// matches old, a nil old expects the reference not to exist.
+func (s *FDBStore) checkReference(tr fdb.Transaction, n plumbing.ReferenceName, old *plumbing.Reference) error {
+	cur, err := s.reference(tr, n)
+	if err == plumbing.ErrReferenceNotFound {
+		if old == nil {
+			return nil
 		}
+		return storage.ErrReferenceHasChanged
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed fetching ref for cas")
+	}
+	if old == nil || cur.Hash() != old.Hash() || cur.Target() != old.Target() {
+		return storage.ErrReferenceHasChanged
 	}
-	return s.SetReference(r)
+	return nil
 }
 
+// CountLooseRefs returns the number of references of the selected namespace
+// written or updated since they were last packed, read from a counter that's
+// kept in the same transactions that change references.
 func (s *FDBStore) CountLooseRefs() (int, error) {
-	//TODO: fix this - just a quick hack to satisfy the storer iface
-	c, err := getKey(s.db, s.genRefCounterKey())
+	c, err := getKey(s.db, s.genRefCounterKey(s.refPrefix))
 	s.log.WithField("count", c).Debug("CoundLooseRefs called")
+	if c < 0 {
+		// counters of refs written before counting was exact may be off
+		c = 0
+	}
 	return int(c), err
 }
 
+// PackRefs packs every loose reference of the selected namespace. Packed
+// references are read like any other, packing only marks them in place so
+// that CountLooseRefs goes back to counting just the references changed
+// since. References are packed a page per transaction.
 func (s *FDBStore) PackRefs() error {
-	s.log.Info("pack refs called")
+	kr, err := s.genRefPrefixRange(s.refPrefix)
+	if err != nil {
+		return errors.Wrap(err, "failed to configure ref range")
+	}
+	packed := 0
+	for {
+		var kvs []fdb.KeyValue
+		var n int
+		_, err := s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+			kvs, n = nil, 0
+			page, err := tr.GetRange(kr, fdb.RangeOptions{Limit: refIterBatch}).GetSliceWithError()
+			if err != nil {
+				return nil, err
+			}
+			for _, kv := range page {
+				if !isLooseRefValue(kv.Value) {
+					continue
+				}
+				name, err := s.refKeyName(kv.Key)
+				if err != nil {
+					return nil, err
+				}
+				r, err := s.decodeReference(name, kv.Value)
+				if err != nil {
+					return nil, err
+				}
+				payload, err := encodeReference(r)
+				if err != nil {
+					return nil, err
+				}
+				tr.Set(kv.Key, packRefValue(payload))
+				s.addLooseRefs(tr, name, -1)
+				n++
+			}
+			kvs = page
+			return
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to pack refs")
+		}
+		packed += n
+		if len(kvs) < refIterBatch {
+			break
+		}
+		kr.Begin = append(append(fdb.Key{}, kvs[len(kvs)-1].Key...), 0x00)
+	}
+	s.log.WithField("packed", packed).Info("packed refs")
 	return nil
 }
 
-func (s *FDBStore) RemoveReference(n plumbing.ReferenceName) error {
-	_, err := s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
-		tr.Clear(s.genRefKey(n))
-		derr := decrKey(tr, s.genRefCounterKey())
-		s.log.WithError(derr).Warning("decr failed")
-		return
-	})
-	return err
+// Adjusts the loose ref counters the reference with full name n counts
+// towards by delta, within an existing transaction.
+func (s *FDBStore) addLooseRefs(tr fdb.Transaction, n plumbing.ReferenceName, delta int64) {
+	for _, k := range s.genRefCounterKeys(n) {
+		addKey(tr, k, delta)
+	}
 }
 
-func (s *FDBStore) IterReferences() (storer.ReferenceIter, error) {
-	//TODO: make this an actual iter, don't just read all refs into a slice
-
-	refs := make([]*plumbing.Reference, 0)
-
-	//prefixKey := fmt.Sprintf("%s.%s.%s", s.ns, refOpKey, s.url)
+func (s *FDBStore) RemoveReference(n plumbing.ReferenceName) error {
+	return s.UpdateReferences([]ReferenceUpdate{{Op: RefDelete, Name: n}})
+}
 
-	rkey, err := fdb.PrefixRange(s.ss[refOpKey].FDBKey())
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to configure prefix key for refs iter")
+// Removes a reference of the selected namespace within an existing
+// transaction, the removal is logged to its reflog if it existed. seq is the
+// position of the change within the transaction.
+func (s *FDBStore) removeReference(tr fdb.Transaction, seq uint16, n plumbing.ReferenceName, l refLogInfo) error {
+	n = s.nsRefName(n)
+	old, loose, err := s.storedReference(tr, n)
+	if err != nil && err != plumbing.ErrReferenceNotFound {
+		return errors.Wrap(err, "failed to read previous ref")
 	}
-
-	_, err = s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
-		resp, err := tr.GetRange(rkey, fdb.RangeOptions{}).GetSliceWithError()
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to get slice on refs iter get rance call")
+	tr.Clear(s.genRefKey(n))
+	if old != nil {
+		if err := s.appendReflog(tr, n, old.Hash(), plumbing.ZeroHash, l); err != nil {
+			return err
 		}
-		if len(resp) == 0 {
-			s.log.Warning("refs iter call has empty resp")
-			return
+		if err := s.recordRefEvent(tr, seq, n, old, nil); err != nil {
+			return err
 		}
-		for i := range resp {
-			//TODO: this is terrible
-			r := new(SlowRef)
-			if err = json.Unmarshal(resp[i].Value, r); err != nil {
-				s.log.WithError(err).Error("unmarshal in iter ref failed")
-				return nil, err
-			}
-			refs = append(refs, plumbing.NewReferenceFromStrings(r.Name, r.Target))
+	}
+	if loose {
+		s.addLooseRefs(tr, n, -1)
+	}
+	return nil
+}
+
+// IterReferences returns an iterator over all references, read a page per
+// transaction so that it works for any number of references.
+func (s *FDBStore) IterReferences() (storer.ReferenceIter, error) {
+	return s.IterReferencesPrefix("")
+}
+
+// IterReferencesPrefix returns an iterator over the references whose name
+// starts with one of prefixes, in name order. Only the key spans of the
+// prefixes are read. Like every reference API it only sees the references of
+// the selected namespace.
+func (s *FDBStore) IterReferencesPrefix(prefixes ...string) (storer.ReferenceIter, error) {
+	ranges := make([]fdb.KeyRange, 0, len(prefixes))
+	for _, p := range dedupePrefixes(prefixes) {
+		r, err := s.genRefPrefixRange(s.refPrefix + p)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to configure prefix key for refs iter")
 		}
-		return nil, nil
-	})
-	return storer.NewReferenceSliceIter(refs), err
+		ranges = append(ranges, r)
+	}
+	return &refIter{s: s, ranges: ranges}, nil
+}
+
+// Hash of r, or the zero hash if r is nil.
+func refHash(r *plumbing.Reference) plumbing.Hash {
+	if r == nil {
+		return plumbing.ZeroHash
+	}
+	return r.Hash()
 }
 
 // key = dir[url]/sub[refs]/tuple[reference name]
@@ -145,6 +304,59 @@ func (s *FDBStore) genRefKey(n plumbing.ReferenceName) fdb.Key {
 	return s.ss[refOpKey].Pack(tuple.Tuple{n.String()})
 }
 
-func (s *FDBStore) genRefCounterKey() fdb.Key {
-	return s.d.Pack(tuple.Tuple{"refs-counter"})
+// Returns the key range of all references whose name starts with prefix.
+func (s *FDBStore) genRefPrefixRange(prefix string) (fdb.KeyRange, error) {
+	return stringPrefixRange(s.ss[refOpKey], prefix)
+}
+
+// Returns the key range of all keys in sub whose first tuple element is a
+// string starting with prefix.
+func stringPrefixRange(sub subspace.Subspace, prefix string) (fdb.KeyRange, error) {
+	// a packed string is terminated by a null byte, without it the key is a
+	// prefix of all longer strings
+	k := sub.Pack(tuple.Tuple{prefix})
+	pr, err := fdb.PrefixRange(k[:len(k)-1])
+	if err != nil {
+		return fdb.KeyRange{}, err
+	}
+	return fdb.KeyRange{Begin: pr.Begin, End: pr.End}, nil
+}
+
+// Returns the name of the reference stored under key k.
+func (s *FDBStore) refKeyName(k fdb.Key) (plumbing.ReferenceName, error) {
+	t, err := s.ss[refOpKey].Unpack(k)
+	if err != nil || len(t) != 1 {
+		return "", errors.Errorf("invalid ref key %s", k)
+	}
+	name, ok := t[0].(string)
+	if !ok {
+		return "", errors.Errorf("invalid ref key %s", k)
+	}
+	return plumbing.ReferenceName(name), nil
+}
+
+// key = dir[url]/tuple[refs-counter] for the root namespace
+// key = dir[url]/tuple[refs-counter, namespace prefix] for other namespaces
+func (s *FDBStore) genRefCounterKey(prefix string) fdb.Key {
+	if prefix == "" {
+		return s.d.Pack(tuple.Tuple{"refs-counter"})
+	}
+	return s.d.Pack(tuple.Tuple{"refs-counter", prefix})
+}
+
+// Returns the counters of the reference with full name n, the root
+// namespace's and that of every namespace n is nested in.
+func (s *FDBStore) genRefCounterKeys(n plumbing.ReferenceName) []fdb.Key {
+	keys := []fdb.Key{s.genRefCounterKey("")}
+	prefix, rest := "", n.String()
+	for strings.HasPrefix(rest, namespaceRefPrefix) {
+		i := strings.Index(rest[len(namespaceRefPrefix):], "/")
+		if i < 0 {
+			break
+		}
+		end := len(namespaceRefPrefix) + i + 1
+		prefix, rest = prefix+rest[:end], rest[end:]
+		keys = append(keys, s.genRefCounterKey(prefix))
+	}
+	return keys
 }
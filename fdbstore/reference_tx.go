@@ -0,0 +1,176 @@
+package fdbstore
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type RefUpdateOp int
+
+const (
+	// RefCreate requires that the reference doesn't exist yet.
+	RefCreate RefUpdateOp = iota
+	// RefUpdate requires the reference to match Old, a nil Old skips the check.
+	RefUpdate
+	// RefDelete removes the reference, checking it against Old if set.
+	RefDelete
+)
+
+func (op RefUpdateOp) String() string {
+	switch op {
+	case RefCreate:
+		return "create"
+	case RefUpdate:
+		return "update"
+	case RefDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("RefUpdateOp(%d)", int(op))
+}
+
+// ReferenceUpdate is a single operation of a reference transaction.
+type ReferenceUpdate struct {
+	Op   RefUpdateOp
+	Name plumbing.ReferenceName
+	// Old is the value the reference is expected to have.
+	Old *plumbing.Reference
+	// New is the value to set, unused for RefDelete.
+	New *plumbing.Reference
+	// Committer and Message are recorded in the reflog, the store's committer
+	// is used if Committer isn't set.
+	Committer *ReflogIdentity
+	Message   string
+}
+
+func (u *ReferenceUpdate) refLog(s *FDBStore) refLogInfo {
+	l := refLogInfo{committer: s.committer, msg: u.Message}
+	if u.Committer != nil {
+		l.committer = *u.Committer
+	}
+	return l
+}
+
+var ErrDuplicateRefUpdate = fmt.Errorf("reference updated more than once in a transaction")
+
+// UpdateReferences applies a batch of reference updates in a single
+// transaction, either every update is committed or none is. If any reference
+// doesn't match its expected value storage.ErrReferenceHasChanged is returned
+// and nothing is written. Every reference change of the store goes through
+// here, pre-update hooks can veto the batch and post-update hooks see it once
+// it's committed. Protection rules on history are checked before the
+// transaction, if the references keep moving while committing
+// storage.ErrReferenceHasChanged is returned.
+func (s *FDBStore) UpdateReferences(updates []ReferenceUpdate) error {
+	if err := validateRefUpdates(updates); err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		checks, err := s.prepareProtection(updates)
+		if err != nil {
+			return err
+		}
+		ret, err := s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+			return s.updateReferences(tr, updates, checks)
+		})
+		if err == errProtectionStale {
+			if attempt == protectionRetries {
+				return storage.ErrReferenceHasChanged
+			}
+			s.log.Debug("references moved while checking their history, retrying")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s.runPostUpdateHooks(ret.([]RefChange))
+		return nil
+	}
+}
+
+// Checks and applies updates within an existing transaction, returning the
+// changes made. All checks and pre-update hooks run before the first write so
+// a failure leaves tr untouched. History rules take their outcome from checks.
+func (s *FDBStore) updateReferences(tr fdb.Transaction, updates []ReferenceUpdate, checks *protectionChecks) ([]RefChange, error) {
+	for _, u := range updates {
+		var err error
+		switch u.Op {
+		case RefCreate:
+			err = s.checkReference(tr, u.Name, nil)
+		case RefUpdate, RefDelete:
+			if u.Old != nil {
+				err = s.checkReference(tr, u.Name, u.Old)
+			}
+		}
+		if err == nil {
+			err = s.checkUpdateProtection(tr, u, checks)
+		}
+		if err != nil {
+			s.log.WithFields(logrus.Fields{"ref_name": u.Name, "op": u.Op}).Debug("ref transaction check failed")
+			return nil, err
+		}
+	}
+	changes, err := s.refChanges(tr, updates)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.runPreUpdateHooks(changes); err != nil {
+		return nil, err
+	}
+	for i := range updates {
+		u := &updates[i]
+		var err error
+		if u.Op == RefDelete {
+			err = s.removeReference(tr, uint16(i), u.Name, u.refLog(s))
+		} else {
+			err = s.setReference(tr, uint16(i), u.New, u.refLog(s))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// Checks u against the protection rules within an existing transaction.
+func (s *FDBStore) checkUpdateProtection(tr fdb.Transaction, u ReferenceUpdate, checks *protectionChecks) error {
+	n := s.nsRefName(u.Name)
+	old, _, err := s.storedReference(tr, n)
+	if err != nil && err != plumbing.ErrReferenceNotFound {
+		return errors.Wrap(err, "failed to read previous ref")
+	}
+	var new *plumbing.Reference
+	if u.Op != RefDelete {
+		new = s.nsRef(u.New)
+	}
+	return s.checkProtection(tr, n, old, new, checks)
+}
+
+func validateRefUpdates(updates []ReferenceUpdate) error {
+	if len(updates) > math.MaxUint16+1 {
+		// changes are numbered in their ref event keys
+		return fmt.Errorf("too many reference updates in a transaction: %d", len(updates))
+	}
+	seen := make(map[plumbing.ReferenceName]bool, len(updates))
+	for _, u := range updates {
+		switch u.Op {
+		case RefCreate, RefUpdate:
+			if u.New == nil || u.New.Name() != u.Name {
+				return fmt.Errorf("invalid %s of %s: new reference must be set and match the name", u.Op, u.Name)
+			}
+		case RefDelete:
+		default:
+			return fmt.Errorf("invalid reference update op %s", u.Op)
+		}
+		if seen[u.Name] {
+			return ErrDuplicateRefUpdate
+		}
+		seen[u.Name] = true
+	}
+	return nil
+}
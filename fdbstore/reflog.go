@@ -0,0 +1,245 @@
+package fdbstore
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+)
+
+// Number of reflog entries read or expired per transaction.
+const reflogBatch = 500
+
+var defaultCommitter = ReflogIdentity{Name: "fdbstore", Email: "fdbstore@localhost"}
+
+// ReflogIdentity identifies who made a reference change.
+type ReflogIdentity struct {
+	Name  string
+	Email string
+}
+
+// ReflogEntry records a single change of a reference. Deleting a reference
+// logs an entry with a zero New hash, the log itself is kept so deleted
+// branches can still be recovered.
+type ReflogEntry struct {
+	Old       plumbing.Hash
+	New       plumbing.Hash
+	Committer ReflogIdentity
+	Time      time.Time
+	Message   string
+	// Version is the versionstamp of the transaction that made the change,
+	// entries of a reference are ordered by it.
+	Version tuple.Versionstamp
+}
+
+// ReflogQuery filters the entries returned by QueryReflog, zero values don't
+// filter.
+type ReflogQuery struct {
+	// Since and Until limit entries to changes made in [Since, Until).
+	Since time.Time
+	Until time.Time
+	// Hash limits entries to those with Hash as their old or new value.
+	Hash plumbing.Hash
+	// Limit caps the number of entries returned.
+	Limit int
+}
+
+func (q *ReflogQuery) match(e *ReflogEntry) bool {
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !e.Time.Before(q.Until) {
+		return false
+	}
+	if !q.Hash.IsZero() && e.Old != q.Hash && e.New != q.Hash {
+		return false
+	}
+	return true
+}
+
+// reflogEntry is how a ReflogEntry is stored, its versionstamp is in the key.
+type reflogEntry struct {
+	Old     string
+	New     string
+	Name    string
+	Email   string
+	Time    int64
+	Message string `json:",omitempty"`
+}
+
+// Who made a change and why, passed down to the reference write path.
+type refLogInfo struct {
+	committer ReflogIdentity
+	msg       string
+}
+
+// Appends a reflog entry for n within an existing transaction. Entries are
+// keyed by the commit versionstamp, so they're ordered by commit even when
+// clocks disagree.
+func (s *FDBStore) appendReflog(tr fdb.Transaction, n plumbing.ReferenceName, old, new plumbing.Hash, l refLogInfo) error {
+	payload, err := json.Marshal(reflogEntry{
+		Old:     old.String(),
+		New:     new.String(),
+		Name:    l.committer.Name,
+		Email:   l.committer.Email,
+		Time:    time.Now().UnixNano(),
+		Message: l.msg,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to encode reflog entry")
+	}
+	key, err := s.genReflogKey(n)
+	if err != nil {
+		return errors.Wrap(err, "failed to pack reflog key")
+	}
+	tr.SetVersionstampedKey(key, payload)
+	return nil
+}
+
+// Reflog returns all entries of the reflog of n in the selected namespace,
+// newest first.
+func (s *FDBStore) Reflog(n plumbing.ReferenceName) ([]*ReflogEntry, error) {
+	return s.QueryReflog(n, ReflogQuery{})
+}
+
+// QueryReflog returns the entries of the reflog of n matching q, newest first.
+func (s *FDBStore) QueryReflog(n plumbing.ReferenceName, q ReflogQuery) ([]*ReflogEntry, error) {
+	entries := make([]*ReflogEntry, 0)
+	kr, err := s.genReflogRange(n)
+	if err != nil {
+		return nil, err
+	}
+	err = s.scanReflog(kr, true, func(_ fdb.Key, e *ReflogEntry) bool {
+		if q.match(e) {
+			entries = append(entries, e)
+		}
+		return q.Limit <= 0 || len(entries) < q.Limit
+	})
+	return entries, err
+}
+
+// ExpireReflog removes entries older than before from the reflog of n, or from
+// the reflogs of all references of the selected namespace if n is empty. It
+// returns the number of entries removed.
+func (s *FDBStore) ExpireReflog(n plumbing.ReferenceName, before time.Time) (int, error) {
+	kr, err := s.genReflogRange(n)
+	if err != nil {
+		return 0, err
+	}
+	expired := 0
+	for {
+		keys := make([]fdb.Key, 0, reflogBatch)
+		done := true
+		err := s.scanReflog(kr, false, func(k fdb.Key, e *ReflogEntry) bool {
+			if !e.Time.Before(before) {
+				// a single log is ordered, nothing newer can be expired
+				return n == ""
+			}
+			keys = append(keys, k)
+			if len(keys) == reflogBatch {
+				done = false
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			return expired, err
+		}
+		if len(keys) > 0 {
+			_, err = s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+				for _, k := range keys {
+					tr.Clear(k)
+				}
+				return
+			})
+			if err != nil {
+				return expired, errors.Wrap(err, "failed to expire reflog entries")
+			}
+			expired += len(keys)
+		}
+		if done {
+			break
+		}
+	}
+	s.log.WithField("ref_name", n).WithField("expired", expired).Debug("expired reflog entries")
+	return expired, nil
+}
+
+// Calls fn with the entries in kr, oldest first or newest first if reverse is
+// set, until fn returns false. Entries are read in pages of reflogBatch, each
+// in its own transaction.
+func (s *FDBStore) scanReflog(kr fdb.KeyRange, reverse bool, fn func(k fdb.Key, e *ReflogEntry) bool) error {
+	for {
+		ret, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
+			ret, e = tr.GetRange(kr, fdb.RangeOptions{Limit: reflogBatch, Reverse: reverse}).GetSliceWithError()
+			return
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to read reflog")
+		}
+		kvs := ret.([]fdb.KeyValue)
+		for _, kv := range kvs {
+			e, err := s.decodeReflogEntry(kv)
+			if err != nil {
+				return err
+			}
+			if !fn(kv.Key, e) {
+				return nil
+			}
+		}
+		if len(kvs) < reflogBatch {
+			return nil
+		}
+		last := kvs[len(kvs)-1].Key
+		if reverse {
+			kr.End = last
+		} else {
+			kr.Begin = append(append(fdb.Key{}, last...), 0x00)
+		}
+	}
+}
+
+func (s *FDBStore) decodeReflogEntry(kv fdb.KeyValue) (*ReflogEntry, error) {
+	t, err := s.ss[reflogOpKey].Unpack(kv.Key)
+	if err != nil || len(t) != 2 {
+		return nil, errors.Errorf("invalid reflog key %s", kv.Key)
+	}
+	v, ok := t[1].(tuple.Versionstamp)
+	if !ok {
+		return nil, errors.Errorf("invalid reflog key %s", kv.Key)
+	}
+	stored := new(reflogEntry)
+	if err := json.Unmarshal(kv.Value, stored); err != nil {
+		return nil, errors.Wrap(err, "failed to decode reflog entry")
+	}
+	return &ReflogEntry{
+		Old:       plumbing.NewHash(stored.Old),
+		New:       plumbing.NewHash(stored.New),
+		Committer: ReflogIdentity{Name: stored.Name, Email: stored.Email},
+		Time:      time.Unix(0, stored.Time),
+		Message:   stored.Message,
+		Version:   v,
+	}, nil
+}
+
+// Returns the key range of the reflog of n in the selected namespace, or of all
+// reflogs in the selected namespace if n is empty.
+func (s *FDBStore) genReflogRange(n plumbing.ReferenceName) (fdb.KeyRange, error) {
+	if n == "" {
+		kr, err := stringPrefixRange(s.ss[reflogOpKey], s.refPrefix)
+		return kr, errors.Wrap(err, "failed to configure reflog range")
+	}
+	pr, err := fdb.PrefixRange(s.ss[reflogOpKey].Sub(s.nsRefName(n).String()).FDBKey())
+	if err != nil {
+		return fdb.KeyRange{}, errors.Wrap(err, "failed to configure reflog range")
+	}
+	return fdb.KeyRange{Begin: pr.Begin, End: pr.End}, nil
+}
+
+// key = dir[url]/sub[reflog]/tuple[reference name, versionstamp]
+func (s *FDBStore) genReflogKey(n plumbing.ReferenceName) (fdb.Key, error) {
+	return s.ss[reflogOpKey].PackWithVersionstamp(tuple.Tuple{n.String(), tuple.IncompleteVersionstamp(0)})
+}
@@ -10,8 +10,7 @@ import (
 
 func (s *FDBStore) Shallow() ([]plumbing.Hash, error) {
 	ret, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
-		ret = tr.Get(fdb.Key(s.genShallowKey())).MustGet()
-		return
+		return s.readValue(tr, s.genShallowKey())
 	})
 
 	if err != nil {
@@ -34,11 +33,7 @@ func (s *FDBStore) SetShallow(hash []plumbing.Hash) error {
 	if err != nil {
 		return errors.Wrap(err, "failed to encode hash")
 	}
-	_, err = s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
-		tr.Set(s.genShallowKey(), payload)
-		return
-	})
-	return err
+	return s.writeValue(s.genShallowKey(), payload, nil)
 }
 
 func (s *FDBStore) genShallowKey() fdb.Key {
@@ -0,0 +1,150 @@
+package fdbstore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/pkg/errors"
+)
+
+// Objects bigger than this are written to a staging area over several
+// transactions, smaller ones are written in a single transaction.
+const maxInlineObjectSize = stageFlushParts * ObjectChunkSize
+
+// Number of pending markers read per transaction during cleanup.
+const stageCleanupBatch = 1000
+
+var ErrStageExpired = fmt.Errorf("staged object write expired")
+
+// A staging area holds the parts of an object that is written across several
+// transactions. While the write is in flight the stage has a pending marker
+// recording when it was created, the marker is cleared in the same
+// transaction that commits the object header. Stages whose marker outlives
+// CleanupStagedObjects' max age are considered aborted and removed.
+
+func newStageID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *FDBStore) markStagePending(tr fdb.Transaction, id string) {
+	tr.Set(s.genStagePendingKey(id), tuple.Tuple{time.Now().UnixNano()}.Pack())
+}
+
+// Fails with ErrStageExpired when the stage was cleaned up while the write
+// was still in progress.
+func (s *FDBStore) checkStagePending(tr fdb.Transaction, id string) error {
+	if isNilKey(tr.Get(s.genStagePendingKey(id)).MustGet()) {
+		return ErrStageExpired
+	}
+	return nil
+}
+
+// CleanupStagedObjects removes staging areas of object writes that were
+// started more than maxAge ago and never committed, returning the number of
+// stages removed.
+func (s *FDBStore) CleanupStagedObjects(maxAge time.Duration) (int, error) {
+	cutoff := time.Now().Add(-maxAge).UnixNano()
+	pending := s.ss[stageOpKey].Sub("pending")
+	begin, end := pending.FDBRangeKeys()
+	removed := 0
+	for {
+		ret, err := s.db.ReadTransact(func(tr fdb.ReadTransaction) (ret interface{}, e error) {
+			ret, e = tr.GetRange(fdb.KeyRange{Begin: begin, End: end}, fdb.RangeOptions{Limit: stageCleanupBatch}).GetSliceWithError()
+			return
+		})
+		if err != nil {
+			return removed, err
+		}
+		kvs := ret.([]fdb.KeyValue)
+		for _, kv := range kvs {
+			t, err := pending.Unpack(kv.Key)
+			if err != nil {
+				return removed, errors.Wrap(err, "failed to decode pending stage key")
+			}
+			id, ok := stageID(t)
+			if !ok {
+				return removed, errors.Errorf("invalid pending stage key %s", kv.Key)
+			}
+			created, ok := stageCreated(kv.Value)
+			if !ok {
+				return removed, errors.Errorf("invalid pending stage marker of stage %s", id)
+			}
+			if created > cutoff {
+				continue
+			}
+			if err := s.removeStage(id, created); err != nil {
+				return removed, err
+			}
+			s.log.WithField("stage", id).Info("removed aborted staged object write")
+			removed++
+		}
+		if len(kvs) < stageCleanupBatch {
+			return removed, nil
+		}
+		begin = fdb.Key(append(kvs[len(kvs)-1].Key, 0x00))
+	}
+}
+
+func stageID(t tuple.Tuple) (string, bool) {
+	if len(t) != 1 {
+		return "", false
+	}
+	id, ok := t[0].(string)
+	return id, ok
+}
+
+// Decodes the creation time held by a pending stage marker.
+func stageCreated(v []byte) (int64, bool) {
+	t, err := tuple.Unpack(v)
+	if err != nil || len(t) != 1 {
+		return 0, false
+	}
+	created, ok := t[0].(int64)
+	return created, ok
+}
+
+// Removes a stage if its pending marker is unchanged, a concurrent commit
+// clearing the marker conflicts with this transaction.
+func (s *FDBStore) removeStage(id string, created int64) error {
+	_, err := s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+		ret = tr.Get(s.genStagePendingKey(id)).MustGet()
+		if isNilKey(ret) {
+			return
+		}
+		if c, ok := stageCreated(ret.([]byte)); !ok || c != created {
+			return
+		}
+		tr.ClearRange(s.ss[stageOpKey].Sub(id))
+		tr.Clear(s.genStagePendingKey(id))
+		return
+	})
+	return err
+}
+
+// Removes a stage whose content is no longer needed.
+func (s *FDBStore) dropStage(id string) error {
+	_, err := s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+		tr.ClearRange(s.ss[stageOpKey].Sub(id))
+		tr.Clear(s.genStagePendingKey(id))
+		return
+	})
+	return err
+}
+
+// key = dir[url]/sub[stage]/tuple[stage id, "part", part]
+func (s *FDBStore) genStagePartKey(id string, part int) fdb.Key {
+	return s.ss[stageOpKey].Pack(tuple.Tuple{id, "part", part})
+}
+
+// key = dir[url]/sub[stage]/tuple["pending", stage id]
+func (s *FDBStore) genStagePendingKey(id string) fdb.Key {
+	return s.ss[stageOpKey].Pack(tuple.Tuple{"pending", id})
+}
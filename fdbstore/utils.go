@@ -36,6 +36,13 @@ func decrKey(tor fdb.Transactor, k fdb.Key) error {
 	return e
 }
 
+// Adds delta to the little endian counter at k within an existing transaction.
+func addKey(tr fdb.Transaction, k fdb.Key, delta int64) {
+	v := make([]byte, 8)
+	binary.LittleEndian.PutUint64(v, uint64(delta))
+	tr.Add(k, v)
+}
+
 func getKey(tor fdb.Transactor, k fdb.Key) (int64, error) {
 	val, e := tor.Transact(func(tr fdb.Transaction) (interface{}, error) {
 		return tr.Get(k).Get()
@@ -0,0 +1,169 @@
+package fdbstore
+
+import (
+	"fmt"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Values up to this size are stored as is, bigger ones are split in chunks
+	// of this size to stay below FDB's value size limit.
+	valueChunkSize = 90000
+	// Bytes of chunks written per transaction.
+	valueWriteBatch = 4 << 20
+	// First byte of the header of a chunked value. Values stored as is never
+	// start with it, as those are git config text or JSON documents.
+	valueHeaderTag byte = 0x00
+)
+
+var ErrValueChanged = fmt.Errorf("value was replaced while being written")
+
+// Documents such as the config, shallow list and index extensions are stored
+// with writeValue and read with readValue, which handle values of any size.
+// Small values are stored as is under their key. Bigger ones are split in
+// chunks under key/tuple[gen, n] and the key holds a header naming the
+// generation, chunk count and size. The chunks of a generation are written
+// over as many transactions as it takes, while in flight the generation has
+// a pending marker. The final transaction clears the marker, switches the
+// header over to the new generation and removes all other generations,
+// including any left behind by failed writes.
+
+// Stores value under key, calling final, if set, in the transaction that makes
+// the new value visible so callers can check their own preconditions.
+func (s *FDBStore) writeValue(key fdb.Key, value []byte, final func(tr fdb.Transaction) error) error {
+	sub := subspace.FromBytes(key)
+	if len(value) <= valueChunkSize && (len(value) == 0 || value[0] != valueHeaderTag) {
+		_, err := s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+			if final != nil {
+				if err := final(tr); err != nil {
+					return nil, err
+				}
+			}
+			begin, end := sub.FDBRangeKeys()
+			tr.ClearRange(fdb.KeyRange{Begin: begin, End: end})
+			tr.Set(key, value)
+			return
+		})
+		return err
+	}
+
+	gen, err := newStageID()
+	if err != nil {
+		return err
+	}
+	chunks := (len(value) + valueChunkSize - 1) / valueChunkSize
+	perTx := valueWriteBatch / valueChunkSize
+	for start := 0; start < chunks; start += perTx {
+		end := start + perTx
+		if end > chunks {
+			end = chunks
+		}
+		_, err := s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+			if start == 0 {
+				tr.Set(s.genValuePendingKey(sub, gen), []byte{1})
+			} else if err := s.checkValuePending(tr, sub, gen); err != nil {
+				return nil, err
+			}
+			for n := start; n < end; n++ {
+				stop := (n + 1) * valueChunkSize
+				if stop > len(value) {
+					stop = len(value)
+				}
+				tr.Set(s.genValueChunkKey(sub, gen, n), value[n*valueChunkSize:stop])
+			}
+			return
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to write value chunks")
+		}
+	}
+
+	_, err = s.db.Transact(func(tr fdb.Transaction) (ret interface{}, e error) {
+		if err := s.checkValuePending(tr, sub, gen); err != nil {
+			return nil, err
+		}
+		if final != nil {
+			if err := final(tr); err != nil {
+				return nil, err
+			}
+		}
+		tr.Clear(s.genValuePendingKey(sub, gen))
+		begin, end := sub.FDBRangeKeys()
+		genBegin, genEnd := sub.Sub(gen).FDBRangeKeys()
+		tr.ClearRange(fdb.KeyRange{Begin: begin, End: genBegin})
+		tr.ClearRange(fdb.KeyRange{Begin: genEnd, End: end})
+		header := tuple.Tuple{gen, int64(chunks), int64(len(value))}.Pack()
+		tr.Set(key, append([]byte{valueHeaderTag}, header...))
+		return
+	})
+	if err != nil {
+		return err
+	}
+	s.log.WithField("chunks", chunks).WithField("size", len(value)).Debug("stored chunked value")
+	return nil
+}
+
+// Reads the value stored under key within an existing transaction, nil if
+// there is none.
+func (s *FDBStore) readValue(tr fdb.ReadTransaction, key fdb.Key) ([]byte, error) {
+	return s.resolveValue(tr, key, tr.Get(key).MustGet())
+}
+
+// Returns the value stored under key given what the key itself holds, v, so
+// callers can fetch several keys at once. Only chunked values take another
+// read.
+func (s *FDBStore) resolveValue(tr fdb.ReadTransaction, key fdb.Key, v []byte) ([]byte, error) {
+	if len(v) == 0 || v[0] != valueHeaderTag {
+		return v, nil
+	}
+	t, err := tuple.Unpack(v[1:])
+	if err != nil || len(t) != 3 {
+		return nil, errors.Errorf("invalid value header under %s", key)
+	}
+	gen, ok := t[0].(string)
+	chunks, ok2 := t[1].(int64)
+	size, ok3 := t[2].(int64)
+	if !ok || !ok2 || !ok3 {
+		return nil, errors.Errorf("invalid value header under %s", key)
+	}
+	begin, end := subspace.FromBytes(key).Sub(gen).FDBRangeKeys()
+	kvs, err := tr.GetRange(fdb.KeyRange{Begin: begin, End: end}, fdb.RangeOptions{Mode: fdb.StreamingModeWantAll}).GetSliceWithError()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read value chunks")
+	}
+	if int64(len(kvs)) != chunks {
+		s.log.WithField("expected", chunks).WithField("found", len(kvs)).Warn("value chunks not found")
+		return nil, errors.Errorf("value under %s is missing chunks", key)
+	}
+	value := make([]byte, 0, size)
+	for _, kv := range kvs {
+		value = append(value, kv.Value...)
+	}
+	if int64(len(value)) != size {
+		return nil, errors.Errorf("value under %s has the wrong size", key)
+	}
+	return value, nil
+}
+
+// Fails with ErrValueChanged once the generation gen was removed by a
+// concurrent write.
+func (s *FDBStore) checkValuePending(tr fdb.Transaction, sub subspace.Subspace, gen string) error {
+	if len(tr.Get(s.genValuePendingKey(sub, gen)).MustGet()) == 0 {
+		return ErrValueChanged
+	}
+	return nil
+}
+
+// key = key/tuple[gen, n]
+func (s *FDBStore) genValueChunkKey(sub subspace.Subspace, gen string, n int) fdb.Key {
+	return sub.Pack(tuple.Tuple{gen, int64(n)})
+}
+
+// key = key/tuple[gen, pending]
+func (s *FDBStore) genValuePendingKey(sub subspace.Subspace, gen string) fdb.Key {
+	return sub.Pack(tuple.Tuple{gen, "pending"})
+}
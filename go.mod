@@ -5,6 +5,7 @@ go 1.19
 require (
 	github.com/apple/foundationdb/bindings/go v0.0.0-20220804194545-4f903724bfcc
 	github.com/go-git/go-git/v5 v5.4.2
+	github.com/klauspost/compress v1.15.9
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.9.0
 )